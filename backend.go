@@ -5,10 +5,14 @@ import (
 	"fmt"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/hashicorp/errwrap"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/consts"
 	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/time/rate"
 )
 
 // backend wraps the backend framework and adds a map for storing key value pairs
@@ -17,6 +21,22 @@ type cognitoSecretBackend struct {
 
 	client client
 	lock   sync.RWMutex
+
+	tidyLock    sync.Mutex
+	lastTidy    time.Time
+	tidyRunning uint32
+
+	// usageLock serialises updates to the role usage counters
+	usageLock sync.Mutex
+
+	// limiter limits the rate of requests made by the backend's clients, it is
+	// kept when the client is reset so that requests in flight stay limited
+	limiter *rate.Limiter
+
+	// requests limits the creds requests that run at once per role and per user
+	// pool, and tokens merges concurrent identical client credentials requests
+	requests *concurrencyLimiter
+	tokens   *coalescer
 }
 
 var _ logical.Factory = Factory
@@ -40,7 +60,11 @@ func Factory(ctx context.Context, conf *logical.BackendConfig) (logical.Backend,
 }
 
 func newBackend() (*cognitoSecretBackend, error) {
-	b := cognitoSecretBackend{}
+	b := cognitoSecretBackend{
+		limiter:  rate.NewLimiter(rate.Inf, 0),
+		requests: newConcurrencyLimiter(),
+		tokens:   newCoalescer(),
+	}
 
 	b.Backend = &framework.Backend{
 		Help: strings.TrimSpace(cognitoHelp),
@@ -54,12 +78,19 @@ func newBackend() (*cognitoSecretBackend, error) {
 			[]*framework.Path{
 				pathConfig(&b),
 				pathCreds(&b),
+				pathTidy(&b),
+				pathUsage(&b),
 			},
+			pathsUsers(&b),
+			pathsRevocations(&b),
+			pathsHealth(&b),
 		),
 		Secrets: []*framework.Secret{
 			secretUser(&b),
 		},
-		BackendType: logical.TypeLogical,
+		BackendType:  logical.TypeLogical,
+		PeriodicFunc: b.periodicFunc,
+		Invalidate:   b.invalidate,
 	}
 
 	return &b, nil
@@ -84,23 +115,30 @@ func (b *cognitoSecretBackend) getClient(ctx context.Context, req *logical.Reque
 
 	config, _ := b.getConfig(ctx, req.Storage)
 
-	if config != nil {
-		c := &clientImpl{
-			AwsAccessKeyId:     config.AwsAccessKeyId,
-			AwsAssumeRoleArn:   config.AwsAssumeRoleArn,
-			AwsSecretAccessKey: config.AwsSecretAccessKey,
-			AwsSessionToken:    config.AwsSessionToken,
-		}
-		b.client = c
-		return c, nil
-	} else {
-		c := &clientImpl{}
-		b.client = c
-		return c, nil
+	if config == nil {
+		config = new(cognitoConfig)
 	}
+
+	limit, burst := config.rateLimit()
+	b.limiter.SetLimit(limit)
+	b.limiter.SetBurst(burst)
+
+	c := &clientImpl{
+		AwsAccessKeyId:     config.AwsAccessKeyId,
+		AwsAssumeRoleArn:   config.AwsAssumeRoleArn,
+		AwsSecretAccessKey: config.AwsSecretAccessKey,
+		AwsSessionToken:    config.AwsSessionToken,
+		MaxRetries:         config.maxRetries(),
+		MinRetryDelay:      config.MinRetryDelay,
+		MaxRetryDelay:      config.MaxRetryDelay,
+		Limiter:            b.limiter,
+	}
+	b.client = c
+	return c, nil
 }
 
-// reset clears the backend's cached client
+// reset clears the backend's cached client, along with the user pool details
+// cached by the client.
 // This is used when the configuration changes and a new client should be
 // created with the updated settings.
 func (b *cognitoSecretBackend) reset() {
@@ -110,6 +148,38 @@ func (b *cognitoSecretBackend) reset() {
 	b.client = nil
 }
 
+// invalidate clears the cached client when the config is changed by another
+// node, e.g. on performance standbys and secondaries, where the config is
+// replicated without pathConfigWrite running. Roles are read from storage on
+// every request, so role changes need no invalidation.
+func (b *cognitoSecretBackend) invalidate(ctx context.Context, key string) {
+	switch key {
+	case configStoragePath:
+		b.reset()
+	}
+}
+
+// periodicFunc runs the backend's background tasks, these only run on nodes
+// that can write to storage.
+func (b *cognitoSecretBackend) periodicFunc(ctx context.Context, req *logical.Request) error {
+	replicationState := b.System().ReplicationState()
+	if replicationState.HasState(consts.ReplicationPerformanceStandby) ||
+		(!b.System().LocalMount() && replicationState.HasState(consts.ReplicationPerformanceSecondary)) {
+		return nil
+	}
+
+	var merr *multierror.Error
+	if err := b.processRevocations(ctx, req); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+
+	if err := b.tidyPeriodic(ctx, req); err != nil {
+		merr = multierror.Append(merr, err)
+	}
+
+	return merr.ErrorOrNil()
+}
+
 func (b *cognitoSecretBackend) handleExistenceCheck(ctx context.Context, req *logical.Request, data *framework.FieldData) (bool, error) {
 	out, err := req.Storage.Get(ctx, req.Path)
 	if err != nil {
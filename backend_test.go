@@ -2,41 +2,162 @@ package cognito
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"sync"
 	"testing"
 
 	log "github.com/hashicorp/go-hclog"
+	gplugin "github.com/hashicorp/go-plugin"
 	"github.com/hashicorp/vault/sdk/helper/logging"
+	"github.com/hashicorp/vault/sdk/helper/pluginutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"github.com/hashicorp/vault/sdk/plugin"
+	"google.golang.org/grpc/metadata"
 )
 
 type mockClient struct {
+	poolUsers         []*poolUser
+	deletedUsers      []string
+	newUserInputs     []*newUserInput
+	updatedAttributes map[string]map[string]string
+	userPool          *userPoolDetails
+	newUserErr        error
+	deleteUserErr     error
+	// clientCredentialsErr, if set, is returned by client credentials grants
+	clientCredentialsErr error
+	callerIdentityErr    error
+	appClient            *appClientDetails
+	actionErrs           map[string]error
+	// accessToken, if set, is returned as the access token of new users and
+	// client credentials grants
+	accessToken string
+	// groups, if set, are the groups that exist in the user pool
+	groups []string
 }
 
-func (c *mockClient) deleteUser(region string, userPoolId string, username string) error {
+func (c *mockClient) deleteUser(ctx context.Context, region string, userPoolId string, username string) error {
+	if c.deleteUserErr != nil {
+		return c.deleteUserErr
+	}
+	c.deletedUsers = append(c.deletedUsers, username)
 	return nil
 }
 
-func (c *mockClient) getClientCredentialsGrant(cognitoPoolDomain, appClientId, appClientSecret string) (map[string]interface{}, error) {
+func (c *mockClient) getClientCredentialsGrant(ctx context.Context, cognitoPoolDomain, appClientId, appClientSecret string) (map[string]interface{}, error) {
+	if c.clientCredentialsErr != nil {
+		return nil, c.clientCredentialsErr
+	}
 
 	rawData := map[string]interface{}{
 		"access_token": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
 		"expires_in":   3600,
 		"token_type":   "Bearer",
 	}
+	if c.accessToken != "" {
+		rawData["access_token"] = c.accessToken
+	}
 
 	return rawData, nil
 }
 
-func (c *mockClient) getNewUser(region string, appClientId string, userPoolId string, group string, dummyEmailDomain string) (map[string]interface{}, error) {
+func (c *mockClient) getNewUser(ctx context.Context, input *newUserInput) (map[string]interface{}, error) {
+	c.newUserInputs = append(c.newUserInputs, input)
+	if c.newUserErr != nil {
+		return nil, c.newUserErr
+	}
 
 	rawData := map[string]interface{}{
 		"username": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA",
 		"password": "BBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBBB",
 	}
+	if c.accessToken != "" {
+		rawData["access_token"] = c.accessToken
+	}
 
 	return rawData, nil
 }
 
+func (c *mockClient) listUsers(ctx context.Context, region string, userPoolId string) ([]*poolUser, error) {
+	return c.poolUsers, nil
+}
+
+func (c *mockClient) updateUserAttributes(ctx context.Context, region string, userPoolId string, username string, attributes map[string]string) error {
+	if c.updatedAttributes == nil {
+		c.updatedAttributes = make(map[string]map[string]string)
+	}
+	c.updatedAttributes[username] = attributes
+	return nil
+}
+
+func (c *mockClient) getUser(ctx context.Context, region string, userPoolId string, username string) (*poolUser, error) {
+	for _, user := range c.poolUsers {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return nil, fmt.Errorf("user %s not found", username)
+}
+
+func (c *mockClient) getCallerIdentity(ctx context.Context, region string) (string, error) {
+	if c.callerIdentityErr != nil {
+		return "", c.callerIdentityErr
+	}
+	return "arn:aws:sts::123456789012:assumed-role/vault/vault", nil
+}
+
+func (c *mockClient) describeUserPoolClient(ctx context.Context, region string, userPoolId string, appClientId string) (*appClientDetails, error) {
+	if c.appClient != nil {
+		return c.appClient, nil
+	}
+	return &appClientDetails{
+		ExplicitAuthFlows: []string{"ALLOW_ADMIN_USER_PASSWORD_AUTH", "ALLOW_REFRESH_TOKEN_AUTH"},
+	}, nil
+}
+
+func (c *mockClient) checkActions(ctx context.Context, region string, userPoolId string, appClientId string) map[string]error {
+	results := map[string]error{
+		"cognito-idp:AdminGetUser":    nil,
+		"cognito-idp:AdminDeleteUser": nil,
+	}
+	for action, err := range c.actionErrs {
+		results[action] = err
+	}
+	return results
+}
+
+func (c *mockClient) getGroup(ctx context.Context, region string, userPoolId string, group string) error {
+	if c.groups == nil {
+		return nil
+	}
+	for _, g := range c.groups {
+		if g == group {
+			return nil
+		}
+	}
+	return fmt.Errorf("group %s not found", group)
+}
+
+func (c *mockClient) getUserPool(ctx context.Context, region string, userPoolId string) (*userPoolDetails, error) {
+	return c.describeUserPool(ctx, region, userPoolId)
+}
+
+func (c *mockClient) describeUserPool(ctx context.Context, region string, userPoolId string) (*userPoolDetails, error) {
+	if c.userPool != nil {
+		return c.userPool, nil
+	}
+
+	return &userPoolDetails{
+		PasswordPolicy: passwordPolicy{
+			MinimumLength:    8,
+			RequireUppercase: true,
+			RequireLowercase: true,
+			RequireNumbers:   true,
+			RequireSymbols:   true,
+		},
+	}, nil
+}
+
 func getTestBackend(t *testing.T, initConfig bool) (*cognitoSecretBackend, logical.Storage) {
 	b, _ := newBackend()
 
@@ -70,3 +191,138 @@ func getMockClient() (client, error) {
 
 	return c, nil
 }
+
+func TestFactoryIsolation(t *testing.T) {
+	newMount := func() *cognitoSecretBackend {
+		b, err := Factory(context.Background(), &logical.BackendConfig{
+			Logger:      logging.NewVaultLogger(log.Trace),
+			System:      &logical.StaticSystemView{},
+			StorageView: &logical.InmemStorage{},
+		})
+		assertErrorIsNil(t, err)
+		return b.(*cognitoSecretBackend)
+	}
+
+	// each mount has its own client, limits and caches, so that mounts served by
+	// one plugin process do not share credentials or state
+	b1, b2 := newMount(), newMount()
+	b1.client, _ = getMockClient()
+	if b2.client != nil {
+		t.Fatal("expected the client not to be shared between mounts")
+	}
+	if b1.limiter == b2.limiter || b1.requests == b2.requests || b1.tokens == b2.tokens {
+		t.Fatal("expected the limiters and caches not to be shared between mounts")
+	}
+
+	b1.Invalidate(context.Background(), "config")
+	if b1.client != nil {
+		t.Fatal("expected the client to be cleared")
+	}
+}
+
+func TestMultiplexedMounts(t *testing.T) {
+	// the mounts are created by the plugin server in the same process, as they
+	// are when the binary is served with plugin.ServeMultiplex
+	var lock sync.Mutex
+	mounts := make(map[string]*cognitoSecretBackend)
+	factory := func(ctx context.Context, conf *logical.BackendConfig) (logical.Backend, error) {
+		id, err := pluginutil.GetMultiplexIDFromContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := Factory(ctx, conf)
+		if err != nil {
+			return nil, err
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		mounts[id] = b.(*cognitoSecretBackend)
+		return b, nil
+	}
+
+	conn, _ := gplugin.TestPluginGRPCConn(t, map[string]gplugin.Plugin{
+		plugin.BackendPluginName: &plugin.GRPCBackendPlugin{
+			Factory:             factory,
+			MultiplexingSupport: true,
+			Logger:              logging.NewVaultLogger(log.Trace),
+		},
+	})
+	defer conn.Close()
+
+	// Vault identifies the mount of each call to a multiplexed plugin with
+	// the multiplex id in the gRPC metadata
+	mount := func(id string) (logical.Backend, context.Context) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), pluginutil.MultiplexingCtxKey, id)
+
+		raw, err := conn.Dispense(plugin.BackendPluginName)
+		assertErrorIsNil(t, err)
+		b := raw.(logical.Backend)
+
+		err = b.Setup(ctx, &logical.BackendConfig{
+			Logger:      logging.NewVaultLogger(log.Trace),
+			System:      &logical.StaticSystemView{},
+			StorageView: &logical.InmemStorage{},
+		})
+		assertErrorIsNil(t, err)
+		return b, ctx
+	}
+
+	b1, ctx1 := mount("mount1")
+	b2, ctx2 := mount("mount2")
+	if len(mounts) != 2 {
+		t.Fatalf("expected a backend per mount, actual: %d", len(mounts))
+	}
+
+	mc1 := &mockClient{}
+	mc2 := &mockClient{newUserErr: errors.New("user pool unavailable")}
+	mounts["mount1"].client = mc1
+	mounts["mount2"].client = mc2
+
+	creds := func(b logical.Backend, ctx context.Context) (*logical.Response, error) {
+		resp, err := b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "roles/test_role",
+			Data: map[string]interface{}{
+				"credential_type": "user",
+				"region":          "eu-west-1",
+				"user_pool_id":    "eu-west-1_aaaa",
+				"group":           "testGroup",
+				"app_client_id":   "testAppClientId",
+			},
+		})
+		assertErrorIsNil(t, err)
+		if resp != nil && resp.IsError() {
+			t.Fatal(resp.Error())
+		}
+
+		return b.HandleRequest(ctx, &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/test_role",
+		})
+	}
+
+	// each mount uses its own client
+	resp, err := creds(b1, ctx1)
+	assertErrorIsNil(t, err)
+	if resp.IsError() {
+		t.Fatal(resp.Error())
+	}
+	equal(t, 1, len(mc1.newUserInputs))
+
+	if _, err := creds(b2, ctx2); err == nil {
+		t.Fatal("expected the second mount to use its own client")
+	}
+	equal(t, 1, len(mc1.newUserInputs))
+	equal(t, 1, len(mc2.newUserInputs))
+
+	// invalidating the config of one mount only clears its client
+	b1.InvalidateKey(ctx1, "config")
+	if mounts["mount1"].client != nil {
+		t.Fatal("expected the client of the first mount to be cleared")
+	}
+	if mounts["mount2"].client != mc2 {
+		t.Fatal("expected the client of the second mount to be kept")
+	}
+}
@@ -1,26 +1,109 @@
 package cognito
 
 import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	b64 "encoding/base64"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
+	"github.com/aws/aws-sdk-go/service/sts"
 	"github.com/hashicorp/errwrap"
 	uuid "github.com/hashicorp/go-uuid"
 	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/time/rate"
 	"io/ioutil"
 	"math/rand"
 	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+// cognitoProviderName is the provider name of users native to a user pool
+const cognitoProviderName = "Cognito"
+
+// userPoolCacheTTL is how long the details of a user pool are cached for, so
+// that changes to the user pool are picked up without writing the config
+const userPoolCacheTTL = 5 * time.Minute
+
 type client interface {
-	deleteUser(region string, userPoolId string, username string) error
-	getClientCredentialsGrant(cognitoPoolDomain string, appClientId string, appClientSecret string) (map[string]interface{}, error)
-	getNewUser(region string, appClientId string, userPoolId string, group string, dummyEmailDomain string) (map[string]interface{}, error)
+	deleteUser(ctx context.Context, region string, userPoolId string, username string) error
+	getClientCredentialsGrant(ctx context.Context, cognitoPoolDomain string, appClientId string, appClientSecret string) (map[string]interface{}, error)
+	getNewUser(ctx context.Context, input *newUserInput) (map[string]interface{}, error)
+	listUsers(ctx context.Context, region string, userPoolId string) ([]*poolUser, error)
+	describeUserPool(ctx context.Context, region string, userPoolId string) (*userPoolDetails, error)
+	// getUserPool returns the details of the user pool, cached for userPoolCacheTTL
+	getUserPool(ctx context.Context, region string, userPoolId string) (*userPoolDetails, error)
+	updateUserAttributes(ctx context.Context, region string, userPoolId string, username string, attributes map[string]string) error
+	getUser(ctx context.Context, region string, userPoolId string, username string) (*poolUser, error)
+	getCallerIdentity(ctx context.Context, region string) (string, error)
+	describeUserPoolClient(ctx context.Context, region string, userPoolId string, appClientId string) (*appClientDetails, error)
+	checkActions(ctx context.Context, region string, userPoolId string, appClientId string) map[string]error
+	getGroup(ctx context.Context, region string, userPoolId string, group string) error
+}
+
+// newUserInput describes the user to be created by getNewUser
+type newUserInput struct {
+	Region      string
+	AppClientId string
+	UserPoolId  string
+	Groups      []string
+	Username    string
+	Password    string
+	// AppClientSecret is required to sign up unconfirmed users when the app
+	// client has a secret
+	AppClientSecret   string
+	ProvisioningState string
+	SendInvitation    bool
+	// Attributes are the user attributes to set on the created user
+	Attributes map[string]string
+	// ClientMetadata is passed to the Lambda triggers of the user pool
+	ClientMetadata map[string]string
+	// ProviderName, ProviderAttributeName and ProviderSubject identify the
+	// identity provider user that the created user is linked to, the user is not
+	// linked if ProviderName is not set
+	ProviderName          string
+	ProviderAttributeName string
+	ProviderSubject       string
+}
+
+// userPoolDetails are the settings of a Cognito user pool that affect the users
+// created in it
+type userPoolDetails struct {
+	PasswordPolicy     passwordPolicy
+	UsernameAttributes []string
+	AliasAttributes    []string
+	RequiredAttributes []string
+}
+
+// appClientDetails are the settings of a Cognito app client that affect the
+// users created with it
+type appClientDetails struct {
+	ExplicitAuthFlows []string
+	HasSecret         bool
+}
+
+// poolUser is a summary of a user that exists in a Cognito user pool
+type poolUser struct {
+	Username    string
+	Email       string
+	PhoneNumber string
+	Status      string
+	Enabled     bool
+	CreateDate  time.Time
+	// Attributes are all of the user's attributes, including custom attributes
+	Attributes map[string]string
 }
 
 type clientImpl struct {
@@ -28,56 +111,238 @@ type clientImpl struct {
 	AwsAssumeRoleArn   string
 	AwsSecretAccessKey string
 	AwsSessionToken    string
+
+	// MaxRetries, MinRetryDelay and MaxRetryDelay control the retries of
+	// throttled and failed requests, a delay of 0 uses the AWS SDK default
+	MaxRetries    int
+	MinRetryDelay time.Duration
+	MaxRetryDelay time.Duration
+	// Limiter limits the rate of requests to AWS and the token endpoint,
+	// including retries
+	Limiter *rate.Limiter
+
+	lock    sync.Mutex
+	sess    *session.Session
+	creds   *credentials.Credentials
+	clients map[string]*cognitoidentityprovider.CognitoIdentityProvider
+
+	// userPools caches the user pool details used by every creds request, it is
+	// cleared along with the client when the config changes
+	userPools userPoolCache
+}
+
+// userPoolCache caches the details of user pools by region and user pool id
+type userPoolCache struct {
+	lock    sync.Mutex
+	entries map[userPool]userPoolCacheEntry
+}
+
+type userPoolCacheEntry struct {
+	details *userPoolDetails
+	expires time.Time
+}
+
+// get returns the cached details of the user pool, or nil if they are not
+// cached or have expired
+func (c *userPoolCache) get(pool userPool, now time.Time) *userPoolDetails {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry, ok := c.entries[pool]
+	if !ok || !now.Before(entry.expires) {
+		return nil
+	}
+	return entry.details
+}
+
+func (c *userPoolCache) put(pool userPool, details *userPoolDetails, now time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.entries == nil {
+		c.entries = make(map[userPool]userPoolCacheEntry)
+	}
+	c.entries[pool] = userPoolCacheEntry{
+		details: details,
+		expires: now.Add(userPoolCacheTTL),
+	}
 }
 
-func (c *clientImpl) deleteUser(region string, userPoolId string, username string) error {
+// cognitoClient returns a Cognito client for the region. The session, and the
+// assumed role credentials, are shared by all regions and cached so that the
+// role is not assumed for every request.
+func (c *clientImpl) cognitoClient(region string) *cognitoidentityprovider.CognitoIdentityProvider {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if cognitoClient, ok := c.clients[region]; ok {
+		return cognitoClient
+	}
+
+	if c.clients == nil {
+		c.clients = make(map[string]*cognitoidentityprovider.CognitoIdentityProvider)
+	}
+	sess := c.session()
+	cognitoClient := cognitoidentityprovider.New(sess, c.clientConfig(region))
+	c.clients[region] = cognitoClient
+
+	return cognitoClient
+}
+
+// stsClient returns an STS client for the region, with the same credentials as
+// the Cognito clients
+func (c *clientImpl) stsClient(region string) *sts.STS {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	sess := c.session()
+	return sts.New(sess, c.clientConfig(region))
+}
+
+// session returns the cached session, creating it if needed, c.lock must be held
+func (c *clientImpl) session() *session.Session {
+	if c.sess != nil {
+		return c.sess
+	}
+
 	config := aws.NewConfig()
 
 	if c.AwsAccessKeyId != "" {
 		creds := credentials.NewStaticCredentials(c.AwsAccessKeyId, c.AwsSecretAccessKey, c.AwsSessionToken)
 		config = config.WithCredentials(creds)
 	}
+	config = request.WithRetryer(config, c.retryer())
 
 	// Initial credentials loaded from SDK's default credential chain. Such as
 	// the environment, shared credentials (~/.aws/credentials), or EC2 Instance
 	// Role. These credentials will be used to to make the STS Assume Role API.
-	sess := session.Must(session.NewSession(config))
-	cognitoProviderConfig := aws.NewConfig().WithRegion(region)
+	c.sess = session.Must(session.NewSession(config))
+	if c.Limiter != nil {
+		// the sign handlers run before every attempt, so retries are limited too
+		c.sess.Handlers.Sign.PushFrontNamed(request.NamedHandler{
+			Name: "cognito.RateLimiter",
+			Fn: func(r *request.Request) {
+				if err := c.Limiter.Wait(r.Context()); err != nil {
+					r.Error = err
+				}
+			},
+		})
+	}
+
+	c.sess.Handlers.Complete.PushBackNamed(request.NamedHandler{
+		Name: "cognito.Metrics",
+		Fn:   recordAPICall,
+	})
 
 	if c.AwsAssumeRoleArn != "" {
-		assumedRoleCreds := stscreds.NewCredentials(sess, c.AwsAssumeRoleArn)
-		cognitoProviderConfig = cognitoProviderConfig.WithCredentials(assumedRoleCreds)
+		c.creds = stscreds.NewCredentials(c.sess, c.AwsAssumeRoleArn)
+	}
+
+	return c.sess
+}
+
+// clientConfig returns the config of a client for the region, using the assumed
+// role credentials if a role is configured, c.lock must be held
+func (c *clientImpl) clientConfig(region string) *aws.Config {
+	config := aws.NewConfig().WithRegion(region)
+	if c.creds != nil {
+		config = config.WithCredentials(c.creds)
 	}
+	return config
+}
 
-	cognitoClient := cognitoidentityprovider.New(sess, cognitoProviderConfig)
+// retryer retries throttled and failed requests with jittered exponential backoff
+func (c *clientImpl) retryer() awsclient.DefaultRetryer {
+	retryer := awsclient.DefaultRetryer{
+		NumMaxRetries:    c.MaxRetries,
+		MinRetryDelay:    awsclient.DefaultRetryerMinRetryDelay,
+		MinThrottleDelay: awsclient.DefaultRetryerMinThrottleDelay,
+		MaxRetryDelay:    awsclient.DefaultRetryerMaxRetryDelay,
+		MaxThrottleDelay: awsclient.DefaultRetryerMaxThrottleDelay,
+	}
+	if c.MinRetryDelay > 0 {
+		retryer.MinRetryDelay = c.MinRetryDelay
+		retryer.MinThrottleDelay = c.MinRetryDelay
+	}
+	if c.MaxRetryDelay > 0 {
+		retryer.MaxRetryDelay = c.MaxRetryDelay
+		retryer.MaxThrottleDelay = c.MaxRetryDelay
+	}
+	return retryer
+}
+
+func (c *clientImpl) deleteUser(ctx context.Context, region string, userPoolId string, username string) error {
+	cognitoClient := c.cognitoClient(region)
 	deleteUserData := &cognitoidentityprovider.AdminDeleteUserInput{
 		UserPoolId: aws.String(userPoolId),
 		Username:   aws.String(username),
 	}
 
-	_, err := cognitoClient.AdminDeleteUser(deleteUserData)
-	return err
+	_, err := cognitoClient.AdminDeleteUserWithContext(ctx, deleteUserData)
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == cognitoidentityprovider.ErrCodeUserNotFoundException {
+		// the user has already been deleted, e.g. with its role
+		return nil
+	}
+	if err != nil {
+		return awsError("cognito-idp:AdminDeleteUser", "Could not delete user", err)
+	}
+	return nil
 }
 
-func (c *clientImpl) getClientCredentialsGrant(cognitoPoolDomain string, appClientId string, appClientSecret string) (map[string]interface{}, error) {
-
-	var rawData map[string]interface{}
+func (c *clientImpl) getClientCredentialsGrant(ctx context.Context, cognitoPoolDomain string, appClientId string, appClientSecret string) (rawData map[string]interface{}, err error) {
+	defer func(start time.Time) {
+		recordTokenRequest(start, err)
+	}(time.Now())
 
 	encodedAppClientSecret := b64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", appClientId, appClientSecret)))
 
 	myClient := &http.Client{}
-	postReq, _ := http.NewRequest("POST", fmt.Sprintf("https://%s/oauth2/token?grant_type=client_credentials&client_id=%s", cognitoPoolDomain, appClientId), nil)
-	postReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	postReq.Header.Set("Authorization", fmt.Sprintf("Basic %s", encodedAppClientSecret))
-	postResp, err := myClient.Do(postReq)
-
-	fetchedData, _ := ioutil.ReadAll(postResp.Body)
-
-	if err != nil {
-		return nil, errwrap.Wrapf("Token request failed: {{err}}", err)
+	retryer := c.retryer()
+
+	var fetchedData []byte
+	for attempt := 0; ; attempt++ {
+		if c.Limiter != nil {
+			if err := c.Limiter.Wait(ctx); err != nil {
+				return nil, errwrap.Wrapf("Token request failed: {{err}}", err)
+			}
+		}
+
+		postReq, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf("https://%s/oauth2/token?grant_type=client_credentials&client_id=%s", cognitoPoolDomain, appClientId), nil)
+		if err != nil {
+			return nil, errwrap.Wrapf("Token request failed: {{err}}", err)
+		}
+		postReq.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		postReq.Header.Set("Authorization", fmt.Sprintf("Basic %s", encodedAppClientSecret))
+
+		postResp, err := myClient.Do(postReq)
+		if err == nil {
+			fetchedData, err = ioutil.ReadAll(postResp.Body)
+			postResp.Body.Close()
+		}
+
+		// network errors, throttling and server errors are retried, other
+		// responses are returned to the caller as is
+		throttled := err == nil && postResp.StatusCode == http.StatusTooManyRequests
+		retryable := err != nil || throttled || postResp.StatusCode >= http.StatusInternalServerError
+		if !retryable {
+			break
+		}
+
+		if attempt >= retryer.NumMaxRetries {
+			if err != nil {
+				return nil, logical.CodedError(http.StatusServiceUnavailable, fmt.Sprintf("Token request failed after %d attempts: %s", attempt+1, err))
+			}
+			return nil, logical.CodedError(postResp.StatusCode, fmt.Sprintf("Token request failed after %d attempts: %s: %s", attempt+1, postResp.Status, fetchedData))
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, errwrap.Wrapf("Token request failed: {{err}}", ctx.Err())
+		case <-time.After(retryDelay(retryer, attempt, throttled)):
+		}
 	}
 
-	if fetchedData == nil {
+	if len(fetchedData) == 0 {
 		return nil, fmt.Errorf("Token was empty")
 	}
 
@@ -88,98 +353,183 @@ func (c *clientImpl) getClientCredentialsGrant(cognitoPoolDomain string, appClie
 	return rawData, nil
 }
 
-func (c *clientImpl) getNewUser(region string, appClientId string, userPoolId string, group string, dummyEmailDomain string) (map[string]interface{}, error) {
-
-	config := aws.NewConfig()
-
-	if c.AwsAccessKeyId != "" {
-		creds := credentials.NewStaticCredentials(c.AwsAccessKeyId, c.AwsSecretAccessKey, c.AwsSessionToken)
-		config = config.WithCredentials(creds)
+// retryDelay returns the delay before retrying a request that has failed
+// attempt+1 times, the delay doubles with each attempt up to the retryer's
+// maximum and is jittered so that concurrent requests do not retry in step.
+func retryDelay(retryer awsclient.DefaultRetryer, attempt int, throttled bool) time.Duration {
+	minDelay, maxDelay := retryer.MinRetryDelay, retryer.MaxRetryDelay
+	if throttled {
+		minDelay, maxDelay = retryer.MinThrottleDelay, retryer.MaxThrottleDelay
 	}
-	// Initial credentials loaded from SDK's default credential chain. Such as
-	// the environment, shared credentials (~/.aws/credentials), or EC2 Instance
-	// Role. These credentials will be used to to make the STS Assume Role API.
-	sess := session.Must(session.NewSession(config))
-	cognitoProviderConfig := aws.NewConfig().WithRegion(region)
 
-	if c.AwsAssumeRoleArn != "" {
-		assumedRoleCreds := stscreds.NewCredentials(sess, c.AwsAssumeRoleArn)
-		cognitoProviderConfig = cognitoProviderConfig.WithCredentials(assumedRoleCreds)
+	delay := minDelay
+	for i := 0; i < attempt && delay < maxDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxDelay {
+		delay = maxDelay
 	}
 
-	cognitoClient := cognitoidentityprovider.New(sess, cognitoProviderConfig)
+	// jitter the delay between half of it and all of it
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
 
-	keyID, err := uuid.GenerateUUID()
-	if err != nil {
-		return nil, errwrap.Wrapf("Could not generate UUID: {{err}}", err)
+func (c *clientImpl) getNewUser(ctx context.Context, input *newUserInput) (rawData map[string]interface{}, err error) {
+	region := input.Region
+	appClientId := input.AppClientId
+	userPoolId := input.UserPoolId
+	username := input.Username
+
+	cognitoClient := c.cognitoClient(region)
+
+	password := input.Password
+
+	// a user that is created but cannot be provisioned, e.g. because a group
+	// does not exist, is deleted so that it does not remain without a lease
+	created := false
+	defer func() {
+		if err == nil || !created {
+			return
+		}
+		// the request may have been cancelled, which must not stop the deletion
+		if deleteErr := c.deleteUser(context.Background(), region, userPoolId, username); deleteErr != nil {
+			err = &userNotDeletedError{Username: username, Err: err, DeleteErr: deleteErr}
+		}
+	}()
+
+	if input.ProvisioningState == provisioningStateUnconfirmed {
+		err := signUp(ctx, cognitoClient, input)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		newUserData := &cognitoidentityprovider.AdminCreateUserInput{
+			TemporaryPassword: aws.String(password),
+			UserAttributes:    attributeTypes(input.Attributes),
+			UserPoolId:        aws.String(userPoolId),
+			Username:          aws.String(username),
+			ClientMetadata:    clientMetadata(input.ClientMetadata),
+		}
+		if input.SendInvitation {
+			if input.Attributes["email"] != "" {
+				newUserData.DesiredDeliveryMediums = append(newUserData.DesiredDeliveryMediums, aws.String("EMAIL"))
+			}
+			if input.Attributes["phone_number"] != "" {
+				newUserData.DesiredDeliveryMediums = append(newUserData.DesiredDeliveryMediums, aws.String("SMS"))
+			}
+		} else {
+			newUserData.MessageAction = aws.String("SUPPRESS")
+		}
+
+		_, err := cognitoClient.AdminCreateUserWithContext(ctx, newUserData)
+		if err != nil {
+			return nil, awsError("cognito-idp:AdminCreateUser", "Could not create user", err)
+		}
+	}
+	created = true
+
+	for _, group := range input.Groups {
+		addUserToGroupData := &cognitoidentityprovider.AdminAddUserToGroupInput{
+			GroupName:  aws.String(group),
+			UserPoolId: aws.String(userPoolId),
+			Username:   aws.String(username),
+		}
+		_, err := cognitoClient.AdminAddUserToGroupWithContext(ctx, addUserToGroupData)
+		if err != nil {
+			return nil, awsError("cognito-idp:AdminAddUserToGroup", fmt.Sprintf("Could not add user to group %s", group), err)
+		}
 	}
 
-	emailID := "vault" + keyID[5:] + "@" + dummyEmailDomain
-	password := generatePassword()
-
-	newUserData := &cognitoidentityprovider.AdminCreateUserInput{
-		MessageAction:     aws.String("SUPPRESS"),
-		TemporaryPassword: aws.String(password),
-		UserAttributes: []*cognitoidentityprovider.AttributeType{
-			{
-				Name:  aws.String("email"),
-				Value: aws.String(emailID),
+	if input.ProviderName != "" {
+		linkProviderForUserData := &cognitoidentityprovider.AdminLinkProviderForUserInput{
+			DestinationUser: &cognitoidentityprovider.ProviderUserIdentifierType{
+				ProviderAttributeValue: aws.String(username),
+				ProviderName:           aws.String(cognitoProviderName),
 			},
-			{
-				Name:  aws.String("email_verified"),
-				Value: aws.String("true"),
+			SourceUser: &cognitoidentityprovider.ProviderUserIdentifierType{
+				ProviderAttributeName:  aws.String(input.ProviderAttributeName),
+				ProviderAttributeValue: aws.String(input.ProviderSubject),
+				ProviderName:           aws.String(input.ProviderName),
 			},
-		},
-		UserPoolId: aws.String(userPoolId),
-		Username:   aws.String(emailID),
+			UserPoolId: aws.String(userPoolId),
+		}
+		_, err := cognitoClient.AdminLinkProviderForUserWithContext(ctx, linkProviderForUserData)
+		if err != nil {
+			return nil, awsError("cognito-idp:AdminLinkProviderForUser", fmt.Sprintf("Could not link user to provider %s", input.ProviderName), err)
+		}
 	}
 
-	_, err = cognitoClient.AdminCreateUser(newUserData)
-	if err != nil {
-		return nil, errwrap.Wrapf("Could not create user: {{err}}", err)
-	}
-	addUserToGroupData := &cognitoidentityprovider.AdminAddUserToGroupInput{
-		GroupName:  aws.String(group),
-		UserPoolId: aws.String(userPoolId),
-		Username:   aws.String(emailID),
-	}
-	_, err = cognitoClient.AdminAddUserToGroup(addUserToGroupData)
-	if err != nil {
-		return nil, errwrap.Wrapf("Could not add user to group: {{err}}", err)
+	switch input.ProvisioningState {
+	case provisioningStateForceChangePassword, provisioningStateUnconfirmed:
+		// the password is the temporary password, or the password for the user
+		// once the sign up has been confirmed
+		return map[string]interface{}{
+			"username": username,
+			"password": password,
+		}, nil
+	case provisioningStateResetRequired:
+		setUserPasswordData := &cognitoidentityprovider.AdminSetUserPasswordInput{
+			Password:   aws.String(password),
+			Permanent:  aws.Bool(true),
+			UserPoolId: aws.String(userPoolId),
+			Username:   aws.String(username),
+		}
+		_, err := cognitoClient.AdminSetUserPasswordWithContext(ctx, setUserPasswordData)
+		if err != nil {
+			return nil, awsError("cognito-idp:AdminSetUserPassword", "Could not set user password", err)
+		}
+
+		resetUserPasswordData := &cognitoidentityprovider.AdminResetUserPasswordInput{
+			UserPoolId:     aws.String(userPoolId),
+			Username:       aws.String(username),
+			ClientMetadata: clientMetadata(input.ClientMetadata),
+		}
+		_, err = cognitoClient.AdminResetUserPasswordWithContext(ctx, resetUserPasswordData)
+		if err != nil {
+			return nil, awsError("cognito-idp:AdminResetUserPassword", "Could not reset user password", err)
+		}
+
+		// the password can no longer be used, the user must reset it with the
+		// code sent by Cognito
+		return map[string]interface{}{
+			"username": username,
+		}, nil
 	}
 
 	adminInitiateAuthData := &cognitoidentityprovider.AdminInitiateAuthInput{
 		AuthFlow: aws.String("ADMIN_NO_SRP_AUTH"),
 		AuthParameters: map[string]*string{
-			"USERNAME": aws.String(emailID),
+			"USERNAME": aws.String(username),
 			"PASSWORD": aws.String(password),
 		},
-		ClientId:   aws.String(appClientId),
-		UserPoolId: aws.String(userPoolId),
+		ClientId:       aws.String(appClientId),
+		UserPoolId:     aws.String(userPoolId),
+		ClientMetadata: clientMetadata(input.ClientMetadata),
 	}
-	sessionResponse, err := cognitoClient.AdminInitiateAuth(adminInitiateAuthData)
+	sessionResponse, err := cognitoClient.AdminInitiateAuthWithContext(ctx, adminInitiateAuthData)
 	if err != nil {
-		return nil, errwrap.Wrapf("Could not init auth: {{err}}", err)
+		return nil, awsError("cognito-idp:AdminInitiateAuth", "Could not init auth", err)
 	}
 
 	adminRespondToAuthChallengeData := &cognitoidentityprovider.AdminRespondToAuthChallengeInput{
 		ChallengeName: aws.String("NEW_PASSWORD_REQUIRED"),
 		ChallengeResponses: map[string]*string{
-			"USERNAME":     aws.String(emailID),
+			"USERNAME":     aws.String(username),
 			"NEW_PASSWORD": aws.String(password),
 		},
-		ClientId:   aws.String(appClientId),
-		Session:    aws.String(*sessionResponse.Session),
-		UserPoolId: aws.String(userPoolId),
+		ClientId:       aws.String(appClientId),
+		Session:        aws.String(*sessionResponse.Session),
+		UserPoolId:     aws.String(userPoolId),
+		ClientMetadata: clientMetadata(input.ClientMetadata),
 	}
 
-	authenticationResult, err := cognitoClient.AdminRespondToAuthChallenge(adminRespondToAuthChallengeData)
+	authenticationResult, err := cognitoClient.AdminRespondToAuthChallengeWithContext(ctx, adminRespondToAuthChallengeData)
 	if err != nil {
-		return nil, errwrap.Wrapf("Could not respond to auth challenge: {{err}}", err)
+		return nil, awsError("cognito-idp:AdminRespondToAuthChallenge", "Could not respond to auth challenge", err)
 	}
 
-	rawData := map[string]interface{}{
-		"username":      emailID,
+	rawData = map[string]interface{}{
+		"username":      username,
 		"password":      password,
 		"access_token":  aws.String(*authenticationResult.AuthenticationResult.AccessToken),
 		"expires_in":    aws.Int64(*authenticationResult.AuthenticationResult.ExpiresIn),
@@ -191,23 +541,348 @@ func (c *clientImpl) getNewUser(region string, appClientId string, userPoolId st
 	return rawData, nil
 }
 
-func generatePassword() string {
-	rand.Seed(time.Now().UnixNano())
-	digits := "0123456789"
-	specials := "~=+%^*/()[]{}/!@#$?|"
-	all := "ABCDEFGHIJKLMNOPQRSTUVWXYZ" +
-		"abcdefghijklmnopqrstuvwxyz" +
-		digits + specials
-	length := 32
-	buf := make([]byte, length)
-	buf[0] = digits[rand.Intn(len(digits))]
-	buf[1] = specials[rand.Intn(len(specials))]
-	for i := 2; i < length; i++ {
-		buf[i] = all[rand.Intn(len(all))]
-	}
-	rand.Shuffle(len(buf), func(i, j int) {
-		buf[i], buf[j] = buf[j], buf[i]
+// signUp registers an unconfirmed user through the app client, as the admin
+// APIs cannot create unconfirmed users.
+func signUp(ctx context.Context, cognitoClient *cognitoidentityprovider.CognitoIdentityProvider, input *newUserInput) error {
+	// contact details are verified when the sign up is confirmed
+	userAttributes := map[string]string{}
+	for name, value := range input.Attributes {
+		if !strings.HasSuffix(name, "_verified") {
+			userAttributes[name] = value
+		}
+	}
+
+	signUpData := &cognitoidentityprovider.SignUpInput{
+		ClientId:       aws.String(input.AppClientId),
+		Password:       aws.String(input.Password),
+		UserAttributes: attributeTypes(userAttributes),
+		Username:       aws.String(input.Username),
+		ClientMetadata: clientMetadata(input.ClientMetadata),
+	}
+	if input.AppClientSecret != "" {
+		signUpData.SecretHash = aws.String(secretHash(input.Username, input.AppClientId, input.AppClientSecret))
+	}
+
+	_, err := cognitoClient.SignUpWithContext(ctx, signUpData)
+	if err != nil {
+		return awsError("cognito-idp:SignUp", "Could not sign up user", err)
+	}
+	return nil
+}
+
+// clientMetadata converts the client metadata for the Cognito API, which
+// rejects an empty map
+func clientMetadata(metadata map[string]string) map[string]*string {
+	if len(metadata) == 0 {
+		return nil
+	}
+	return aws.StringMap(metadata)
+}
+
+// secretHash calculates the secret hash required by app clients that have a secret
+func secretHash(username string, appClientId string, appClientSecret string) string {
+	mac := hmac.New(sha256.New, []byte(appClientSecret))
+	mac.Write([]byte(username + appClientId))
+	return b64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// listUsers returns all of the users in the user pool. Custom attributes cannot
+// be used in a ListUsers filter, so the users are not filtered.
+func (c *clientImpl) listUsers(ctx context.Context, region string, userPoolId string) ([]*poolUser, error) {
+	cognitoClient := c.cognitoClient(region)
+	listUsersData := &cognitoidentityprovider.ListUsersInput{
+		UserPoolId: aws.String(userPoolId),
+	}
+
+	var users []*poolUser
+	err := cognitoClient.ListUsersPagesWithContext(ctx, listUsersData, func(page *cognitoidentityprovider.ListUsersOutput, lastPage bool) bool {
+		for _, u := range page.Users {
+			user := &poolUser{
+				Username:   aws.StringValue(u.Username),
+				Status:     aws.StringValue(u.UserStatus),
+				Enabled:    aws.BoolValue(u.Enabled),
+				CreateDate: aws.TimeValue(u.UserCreateDate),
+			}
+			user.setAttributes(u.Attributes)
+			users = append(users, user)
+		}
+		return true
 	})
-	str := string(buf) // E.g. "3i[g0|)z"
-	return str
+	if err != nil {
+		return nil, awsError("cognito-idp:ListUsers", "Could not list users", err)
+	}
+
+	return users, nil
+}
+
+// getUserPool returns the details of the user pool from the cache, describing
+// the user pool if they are not cached. DescribeUserPool has a low quota, so it
+// is not called for every creds request.
+func (c *clientImpl) getUserPool(ctx context.Context, region string, userPoolId string) (*userPoolDetails, error) {
+	pool := userPool{Region: region, UserPoolId: userPoolId}
+	if details := c.userPools.get(pool, time.Now()); details != nil {
+		return details, nil
+	}
+
+	details, err := c.describeUserPool(ctx, region, userPoolId)
+	if err != nil {
+		return nil, err
+	}
+
+	c.userPools.put(pool, details, time.Now())
+	return details, nil
+}
+
+func (c *clientImpl) describeUserPool(ctx context.Context, region string, userPoolId string) (*userPoolDetails, error) {
+	cognitoClient := c.cognitoClient(region)
+	describeUserPoolData := &cognitoidentityprovider.DescribeUserPoolInput{
+		UserPoolId: aws.String(userPoolId),
+	}
+
+	output, err := cognitoClient.DescribeUserPoolWithContext(ctx, describeUserPoolData)
+	if err != nil {
+		return nil, awsError("cognito-idp:DescribeUserPool", "Could not describe user pool", err)
+	}
+
+	details := &userPoolDetails{
+		UsernameAttributes: aws.StringValueSlice(output.UserPool.UsernameAttributes),
+		AliasAttributes:    aws.StringValueSlice(output.UserPool.AliasAttributes),
+	}
+	for _, attribute := range output.UserPool.SchemaAttributes {
+		if aws.BoolValue(attribute.Required) {
+			details.RequiredAttributes = append(details.RequiredAttributes, aws.StringValue(attribute.Name))
+		}
+	}
+	if output.UserPool.Policies != nil && output.UserPool.Policies.PasswordPolicy != nil {
+		policy := output.UserPool.Policies.PasswordPolicy
+		details.PasswordPolicy = passwordPolicy{
+			MinimumLength:    int(aws.Int64Value(policy.MinimumLength)),
+			RequireUppercase: aws.BoolValue(policy.RequireUppercase),
+			RequireLowercase: aws.BoolValue(policy.RequireLowercase),
+			RequireNumbers:   aws.BoolValue(policy.RequireNumbers),
+			RequireSymbols:   aws.BoolValue(policy.RequireSymbols),
+		}
+	}
+
+	return details, nil
+}
+
+func (c *clientImpl) updateUserAttributes(ctx context.Context, region string, userPoolId string, username string, attributes map[string]string) error {
+	cognitoClient := c.cognitoClient(region)
+	updateUserAttributesData := &cognitoidentityprovider.AdminUpdateUserAttributesInput{
+		UserAttributes: attributeTypes(attributes),
+		UserPoolId:     aws.String(userPoolId),
+		Username:       aws.String(username),
+	}
+
+	_, err := cognitoClient.AdminUpdateUserAttributesWithContext(ctx, updateUserAttributesData)
+	if err != nil {
+		return awsError("cognito-idp:AdminUpdateUserAttributes", "Could not update user attributes", err)
+	}
+	return nil
+}
+
+// attributeTypes converts a map of attribute names and values to Cognito
+// attribute types, ordered by name.
+func attributeTypes(attributes map[string]string) []*cognitoidentityprovider.AttributeType {
+	names := make([]string, 0, len(attributes))
+	for name := range attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	attributeTypes := make([]*cognitoidentityprovider.AttributeType, 0, len(names))
+	for _, name := range names {
+		attributeTypes = append(attributeTypes, &cognitoidentityprovider.AttributeType{
+			Name:  aws.String(name),
+			Value: aws.String(attributes[name]),
+		})
+	}
+	return attributeTypes
+}
+
+func (c *clientImpl) getUser(ctx context.Context, region string, userPoolId string, username string) (*poolUser, error) {
+	cognitoClient := c.cognitoClient(region)
+	getUserData := &cognitoidentityprovider.AdminGetUserInput{
+		UserPoolId: aws.String(userPoolId),
+		Username:   aws.String(username),
+	}
+
+	output, err := cognitoClient.AdminGetUserWithContext(ctx, getUserData)
+	if err != nil {
+		return nil, awsError("cognito-idp:AdminGetUser", "Could not get user", err)
+	}
+
+	user := &poolUser{
+		Username:   aws.StringValue(output.Username),
+		Status:     aws.StringValue(output.UserStatus),
+		Enabled:    aws.BoolValue(output.Enabled),
+		CreateDate: aws.TimeValue(output.UserCreateDate),
+	}
+	user.setAttributes(output.UserAttributes)
+
+	return user, nil
+}
+
+// setAttributes records the attributes of the user returned by Cognito
+func (u *poolUser) setAttributes(attributes []*cognitoidentityprovider.AttributeType) {
+	u.Attributes = make(map[string]string, len(attributes))
+	for _, attribute := range attributes {
+		name, value := aws.StringValue(attribute.Name), aws.StringValue(attribute.Value)
+		u.Attributes[name] = value
+		switch name {
+		case "email":
+			u.Email = value
+		case "phone_number":
+			u.PhoneNumber = value
+		}
+	}
+}
+
+func (c *clientImpl) getCallerIdentity(ctx context.Context, region string) (string, error) {
+	output, err := c.stsClient(region).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return "", awsError("sts:GetCallerIdentity", "Could not validate AWS credentials", err)
+	}
+
+	return aws.StringValue(output.Arn), nil
+}
+
+func (c *clientImpl) describeUserPoolClient(ctx context.Context, region string, userPoolId string, appClientId string) (*appClientDetails, error) {
+	cognitoClient := c.cognitoClient(region)
+	describeUserPoolClientData := &cognitoidentityprovider.DescribeUserPoolClientInput{
+		UserPoolId: aws.String(userPoolId),
+		ClientId:   aws.String(appClientId),
+	}
+
+	output, err := cognitoClient.DescribeUserPoolClientWithContext(ctx, describeUserPoolClientData)
+	if err != nil {
+		return nil, awsError("cognito-idp:DescribeUserPoolClient", "Could not describe app client", err)
+	}
+
+	return &appClientDetails{
+		ExplicitAuthFlows: aws.StringValueSlice(output.UserPoolClient.ExplicitAuthFlows),
+		HasSecret:         aws.StringValue(output.UserPoolClient.ClientSecret) != "",
+	}, nil
+}
+
+// checkActions checks that the IAM actions used to manage users are allowed, by
+// calling them for a user that does not exist. An allowed call fails because
+// the user, or the group, is not found and leaves the user pool unchanged. The
+// returned map holds the error of each action that is not allowed, or nil.
+//
+// AdminCreateUser, AdminRespondToAuthChallenge, AdminLinkProviderForUser and
+// SignUp are not checked, as they cannot be called without changing the user
+// pool or without a user that exists.
+func (c *clientImpl) checkActions(ctx context.Context, region string, userPoolId string, appClientId string) map[string]error {
+	cognitoClient := c.cognitoClient(region)
+
+	probeId, err := uuid.GenerateUUID()
+	if err != nil {
+		probeId = fmt.Sprint(time.Now().UnixNano())
+	}
+	username := aws.String("vault-check-" + probeId)
+	password := aws.String("Vault-check-" + probeId)
+
+	checks := map[string]func() error{
+		"cognito-idp:AdminGetUser": func() error {
+			_, err := cognitoClient.AdminGetUserWithContext(ctx, &cognitoidentityprovider.AdminGetUserInput{
+				UserPoolId: aws.String(userPoolId),
+				Username:   username,
+			})
+			return err
+		},
+		"cognito-idp:AdminDeleteUser": func() error {
+			_, err := cognitoClient.AdminDeleteUserWithContext(ctx, &cognitoidentityprovider.AdminDeleteUserInput{
+				UserPoolId: aws.String(userPoolId),
+				Username:   username,
+			})
+			return err
+		},
+		"cognito-idp:AdminAddUserToGroup": func() error {
+			_, err := cognitoClient.AdminAddUserToGroupWithContext(ctx, &cognitoidentityprovider.AdminAddUserToGroupInput{
+				UserPoolId: aws.String(userPoolId),
+				Username:   username,
+				GroupName:  username,
+			})
+			return err
+		},
+		"cognito-idp:AdminUpdateUserAttributes": func() error {
+			_, err := cognitoClient.AdminUpdateUserAttributesWithContext(ctx, &cognitoidentityprovider.AdminUpdateUserAttributesInput{
+				UserPoolId:     aws.String(userPoolId),
+				Username:       username,
+				UserAttributes: attributeTypes(map[string]string{"name": "vault-check"}),
+			})
+			return err
+		},
+		"cognito-idp:AdminSetUserPassword": func() error {
+			_, err := cognitoClient.AdminSetUserPasswordWithContext(ctx, &cognitoidentityprovider.AdminSetUserPasswordInput{
+				UserPoolId: aws.String(userPoolId),
+				Username:   username,
+				Password:   password,
+			})
+			return err
+		},
+		"cognito-idp:AdminResetUserPassword": func() error {
+			_, err := cognitoClient.AdminResetUserPasswordWithContext(ctx, &cognitoidentityprovider.AdminResetUserPasswordInput{
+				UserPoolId: aws.String(userPoolId),
+				Username:   username,
+			})
+			return err
+		},
+		"cognito-idp:AdminInitiateAuth": func() error {
+			_, err := cognitoClient.AdminInitiateAuthWithContext(ctx, &cognitoidentityprovider.AdminInitiateAuthInput{
+				UserPoolId: aws.String(userPoolId),
+				ClientId:   aws.String(appClientId),
+				AuthFlow:   aws.String(cognitoidentityprovider.AuthFlowTypeAdminNoSrpAuth),
+				AuthParameters: map[string]*string{
+					"USERNAME": username,
+					"PASSWORD": password,
+				},
+			})
+			return err
+		},
+		"cognito-idp:ListUsers": func() error {
+			_, err := cognitoClient.ListUsersWithContext(ctx, &cognitoidentityprovider.ListUsersInput{
+				UserPoolId: aws.String(userPoolId),
+				Limit:      aws.Int64(1),
+			})
+			return err
+		},
+	}
+
+	results := make(map[string]error, len(checks))
+	for action, check := range checks {
+		results[action] = checkActionError(action, check())
+	}
+	return results
+}
+
+// checkActionError returns nil if the error of a call made by checkActions shows
+// that the action is allowed, i.e. the call was authorised and then failed
+// because its user does not exist
+func checkActionError(action string, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if aerr, ok := err.(awserr.Error); ok && strutil.StrListContains(checkActionErrorCodes, aerr.Code()) {
+		return nil
+	}
+
+	return awsError(action, "Could not check action", err)
+}
+
+func (c *clientImpl) getGroup(ctx context.Context, region string, userPoolId string, group string) error {
+	cognitoClient := c.cognitoClient(region)
+	getGroupData := &cognitoidentityprovider.GetGroupInput{
+		UserPoolId: aws.String(userPoolId),
+		GroupName:  aws.String(group),
+	}
+
+	_, err := cognitoClient.GetGroupWithContext(ctx, getGroupData)
+	if err != nil {
+		return awsError("cognito-idp:GetGroup", fmt.Sprintf("Could not get group %s", group), err)
+	}
+	return nil
 }
@@ -0,0 +1,163 @@
+package cognito
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
+)
+
+func TestClientCredentialsGrantCancelled(t *testing.T) {
+	c := &clientImpl{
+		MaxRetries:    3,
+		MinRetryDelay: time.Minute,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// a cancelled request is neither sent nor retried
+	start := time.Now()
+	_, err := c.getClientCredentialsGrant(ctx, "example.invalid", "testAppClientId", "testAppClientSecret")
+	if err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Fatalf("expected the request to be cancelled, actual: %v", err)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Fatalf("expected the cancelled request to return without retrying, took: %s", time.Since(start))
+	}
+}
+
+func TestUserPoolCache(t *testing.T) {
+	c := &clientImpl{}
+	pool := userPool{Region: "eu-west-1", UserPoolId: "eu-west-1_aaaa"}
+	details := &userPoolDetails{UsernameAttributes: []string{"email"}}
+	now := time.Now()
+
+	c.userPools.put(pool, details, now)
+
+	// a cancelled request can only succeed if the user pool is not described
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	actual, err := c.getUserPool(ctx, pool.Region, pool.UserPoolId)
+	assertErrorIsNil(t, err)
+	if actual != details {
+		t.Fatalf("expected the cached details, actual: %#v", actual)
+	}
+
+	if c.userPools.get(userPool{Region: "eu-west-1", UserPoolId: "eu-west-1_bbbb"}, now) != nil {
+		t.Fatal("expected other user pools not to be cached")
+	}
+	if c.userPools.get(pool, now.Add(userPoolCacheTTL)) != nil {
+		t.Fatal("expected the cached details to expire")
+	}
+}
+
+// testCognitoClient returns a client whose Cognito requests in eu-west-1 are
+// handled by a test server, which fails the actions in errs with their error
+// code and records the actions that are called
+func testCognitoClient(t *testing.T, errs map[string]string) (*clientImpl, func() []string) {
+	var lock sync.Mutex
+	var actions []string
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		action := strings.TrimPrefix(r.Header.Get("X-Amz-Target"), "AWSCognitoIdentityProviderService.")
+		lock.Lock()
+		actions = append(actions, action)
+		lock.Unlock()
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		if code, ok := errs[action]; ok {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":"%s","message":"%s failed"}`, code, action)
+			return
+		}
+		fmt.Fprint(w, "{}")
+	}))
+	t.Cleanup(server.Close)
+
+	sess := session.Must(session.NewSession(aws.NewConfig().
+		WithEndpoint(server.URL).
+		WithRegion("eu-west-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", "")).
+		WithMaxRetries(0)))
+
+	c := &clientImpl{
+		clients: map[string]*cognitoidentityprovider.CognitoIdentityProvider{
+			"eu-west-1": cognitoidentityprovider.New(sess),
+		},
+	}
+
+	return c, func() []string {
+		lock.Lock()
+		defer lock.Unlock()
+		return append([]string(nil), actions...)
+	}
+}
+
+func TestGetNewUserDeletesPartlyCreatedUser(t *testing.T) {
+	input := &newUserInput{
+		Region:            "eu-west-1",
+		UserPoolId:        "eu-west-1_aaaa",
+		AppClientId:       "testAppClientId",
+		Groups:            []string{"missingGroup"},
+		Username:          "vault12345",
+		Password:          "Password1!",
+		ProvisioningState: provisioningStateForceChangePassword,
+	}
+
+	t.Run("The user is deleted", func(t *testing.T) {
+		c, actions := testCognitoClient(t, map[string]string{
+			"AdminAddUserToGroup": cognitoidentityprovider.ErrCodeResourceNotFoundException,
+		})
+
+		_, err := c.getNewUser(context.Background(), input)
+		if err == nil || !strings.Contains(err.Error(), "Could not add user to group missingGroup") {
+			t.Fatalf("expected the group error, actual: %v", err)
+		}
+		var notDeleted *userNotDeletedError
+		if errors.As(err, &notDeleted) {
+			t.Fatalf("expected the user to be deleted, actual: %v", err)
+		}
+		equal(t, []string{"AdminCreateUser", "AdminAddUserToGroup", "AdminDeleteUser"}, actions())
+	})
+
+	t.Run("The user cannot be deleted", func(t *testing.T) {
+		c, actions := testCognitoClient(t, map[string]string{
+			"AdminAddUserToGroup": cognitoidentityprovider.ErrCodeResourceNotFoundException,
+			"AdminDeleteUser":     cognitoidentityprovider.ErrCodeInternalErrorException,
+		})
+
+		_, err := c.getNewUser(context.Background(), input)
+		var notDeleted *userNotDeletedError
+		if !errors.As(err, &notDeleted) {
+			t.Fatalf("expected the user not to be deleted, actual: %v", err)
+		}
+		equal(t, "vault12345", notDeleted.Username)
+		if !strings.Contains(notDeleted.Err.Error(), "Could not add user to group missingGroup") {
+			t.Fatalf("expected the group error, actual: %v", notDeleted.Err)
+		}
+		equal(t, []string{"AdminCreateUser", "AdminAddUserToGroup", "AdminDeleteUser"}, actions())
+	})
+
+	t.Run("A user that is not created is not deleted", func(t *testing.T) {
+		c, actions := testCognitoClient(t, map[string]string{
+			"AdminCreateUser": cognitoidentityprovider.ErrCodeUsernameExistsException,
+		})
+
+		_, err := c.getNewUser(context.Background(), input)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+		equal(t, []string{"AdminCreateUser"}, actions())
+	})
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"os"
 
+	metrics "github.com/armon/go-metrics"
 	cognito "github.com/dave-shepherd/vault/plugins/vault-plugin-secrets-cognito"
 	"github.com/hashicorp/go-hclog"
 	"github.com/hashicorp/vault/api"
@@ -12,12 +13,26 @@ import (
 func main() {
 	apiClientMeta := &api.PluginAPIClientMeta{}
 	flags := apiClientMeta.FlagSet()
+	statsdAddress := flags.String("statsd-address", "", "The address of a statsd server to send the plugin's metrics to (Optional).")
 	flags.Parse(os.Args[1:])
 
+	// metrics are not passed to Vault by the plugin process, so they are sent
+	// to statsd directly
+	if *statsdAddress != "" {
+		if err := setupMetrics(*statsdAddress); err != nil {
+			logger := hclog.New(&hclog.LoggerOptions{})
+
+			logger.Error("failed to set up metrics", "error", err)
+			os.Exit(1)
+		}
+	}
+
 	tlsConfig := apiClientMeta.GetTLSConfig()
 	tlsProviderFunc := api.VaultPluginTLSProvider(tlsConfig)
 
-	err := plugin.Serve(&plugin.ServeOpts{
+	// Vault versions that support multiplexing serve all mounts of the plugin
+	// from this process, older versions start a process per mount
+	err := plugin.ServeMultiplex(&plugin.ServeOpts{
 		BackendFactoryFunc: cognito.Factory,
 		TLSProviderFunc:    tlsProviderFunc,
 	})
@@ -28,3 +43,19 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+func setupMetrics(statsdAddress string) error {
+	sink, err := metrics.NewStatsdSink(statsdAddress)
+	if err != nil {
+		return err
+	}
+
+	config := metrics.DefaultConfig("vault")
+	config.EnableHostname = false
+	config.EnableHostnameLabel = true
+	// the runtime metrics of the plugin process would be confused with Vault's
+	config.EnableRuntimeMetrics = false
+
+	_, err = metrics.NewGlobal(config, sink)
+	return err
+}
@@ -0,0 +1,203 @@
+package cognito
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// concurrencyLimiter limits the number of requests that run at once for a key,
+// e.g. a role or a user pool. Requests over the limit wait in a queue for a
+// slot, so that a burst of requests reaches Cognito at a steady pace.
+type concurrencyLimiter struct {
+	lock       sync.Mutex
+	semaphores map[string]*semaphore
+}
+
+type semaphore struct {
+	slots   chan struct{}
+	waiting int
+}
+
+func newConcurrencyLimiter() *concurrencyLimiter {
+	return &concurrencyLimiter{
+		semaphores: make(map[string]*semaphore),
+	}
+}
+
+// acquire waits for one of the limit slots of key, key describes what is limited
+// e.g. "role 'test'". A 429 coded error is returned if maxQueued requests are
+// already waiting or if no slot is free within maxWait, a maxQueued or maxWait
+// of 0 does not bound the queue. A limit of 0 does not limit requests.
+//
+// The returned function must be called to release the slot.
+func (l *concurrencyLimiter) acquire(ctx context.Context, key string, limit int, maxQueued int, maxWait time.Duration) (func(), error) {
+	if limit <= 0 {
+		return func() {}, nil
+	}
+
+	l.lock.Lock()
+	sem, ok := l.semaphores[key]
+	if !ok || cap(sem.slots) != limit {
+		// the limit has changed, requests holding a slot of the previous
+		// semaphore release it there
+		sem = &semaphore{slots: make(chan struct{}, limit)}
+		l.semaphores[key] = sem
+	}
+
+	select {
+	case sem.slots <- struct{}{}:
+		l.lock.Unlock()
+		return sem.release, nil
+	default:
+	}
+
+	if maxQueued > 0 && sem.waiting >= maxQueued {
+		l.lock.Unlock()
+		return nil, logical.CodedError(http.StatusTooManyRequests, fmt.Sprintf("too many concurrent requests for %s, %d requests are already queued, retry later", key, maxQueued))
+	}
+	sem.waiting++
+	l.lock.Unlock()
+
+	defer func() {
+		l.lock.Lock()
+		sem.waiting--
+		l.lock.Unlock()
+	}()
+
+	var timeout <-chan time.Time
+	if maxWait > 0 {
+		timer := time.NewTimer(maxWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case sem.slots <- struct{}{}:
+		return sem.release, nil
+	case <-timeout:
+		return nil, logical.CodedError(http.StatusTooManyRequests, fmt.Sprintf("too many concurrent requests for %s, no request finished within %s, retry later", key, maxWait))
+	case <-ctx.Done():
+		return nil, errwrap.Wrapf(fmt.Sprintf("request cancelled while queued for %s: {{err}}", key), ctx.Err())
+	}
+}
+
+func (s *semaphore) release() {
+	<-s.slots
+}
+
+// coalescer merges identical concurrent calls into one, the callers that arrive
+// while a call is running wait for it and share its result.
+type coalescer struct {
+	lock  sync.Mutex
+	calls map[string]*coalescedCall
+}
+
+type coalescedCall struct {
+	// ctx is the context of the caller that runs the call
+	ctx  context.Context
+	done chan struct{}
+	data map[string]interface{}
+	err  error
+}
+
+func newCoalescer() *coalescer {
+	return &coalescer{
+		calls: make(map[string]*coalescedCall),
+	}
+}
+
+// do runs fn, unless a call with the same key is running, in which case the
+// result of that call is returned and shared is true. Each caller gets its own
+// copy of the data.
+func (c *coalescer) do(ctx context.Context, key string, fn func(ctx context.Context) (map[string]interface{}, error)) (data map[string]interface{}, shared bool, err error) {
+	for {
+		c.lock.Lock()
+		call, ok := c.calls[key]
+		if !ok {
+			call = &coalescedCall{ctx: ctx, done: make(chan struct{})}
+			c.calls[key] = call
+			c.lock.Unlock()
+
+			call.data, call.err = fn(ctx)
+
+			c.lock.Lock()
+			delete(c.calls, key)
+			c.lock.Unlock()
+			close(call.done)
+
+			return copyData(call.data), false, call.err
+		}
+		c.lock.Unlock()
+
+		select {
+		case <-call.done:
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		}
+
+		// the call failed because its caller went away, rather than share that
+		// failure the call is made again
+		if call.err != nil && call.ctx.Err() != nil && ctx.Err() == nil {
+			continue
+		}
+
+		return copyData(call.data), true, call.err
+	}
+}
+
+func copyData(data map[string]interface{}) map[string]interface{} {
+	if data == nil {
+		return nil
+	}
+
+	copied := make(map[string]interface{}, len(data))
+	for k, v := range data {
+		copied[k] = v
+	}
+	return copied
+}
+
+// acquireCredsSlots waits for a slot for the role and then for the user pool,
+// or token endpoint, that a creds request uses. The returned function must be
+// called to release both slots.
+func (b *cognitoSecretBackend) acquireCredsSlots(ctx context.Context, s logical.Storage, roleName string, pool string) (func(), error) {
+	config, err := b.getConfig(ctx, s)
+	if err != nil {
+		return nil, err
+	}
+
+	if config == nil {
+		config = new(cognitoConfig)
+	}
+
+	releaseRole, err := b.requests.acquire(ctx, fmt.Sprintf("role '%s'", roleName), config.MaxConcurrentRequestsPerRole, config.MaxQueuedRequests, config.MaxQueueWait)
+	if err != nil {
+		return nil, err
+	}
+
+	releasePool, err := b.requests.acquire(ctx, pool, config.MaxConcurrentRequestsPerPool, config.MaxQueuedRequests, config.MaxQueueWait)
+	if err != nil {
+		releaseRole()
+		return nil, err
+	}
+
+	return func() {
+		releasePool()
+		releaseRole()
+	}, nil
+}
+
+// tokenRequestKey identifies identical client credentials requests, the secret
+// is hashed so that it is not kept as a key
+func tokenRequestKey(cognitoPoolDomain string, appClientId string, appClientSecret string) string {
+	secret := sha256.Sum256([]byte(appClientSecret))
+	return fmt.Sprintf("%s/%s/%s", cognitoPoolDomain, appClientId, hex.EncodeToString(secret[:]))
+}
@@ -0,0 +1,153 @@
+package cognito
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	l := newConcurrencyLimiter()
+	ctx := context.Background()
+
+	release, err := l.acquire(ctx, "role 'test'", 1, 1, time.Minute)
+	assertErrorIsNil(t, err)
+
+	// the second request is queued until the first is released
+	acquired := make(chan func())
+	go func() {
+		release, err := l.acquire(ctx, "role 'test'", 1, 1, time.Minute)
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+
+	waitForQueued(t, l, "role 'test'", 1)
+
+	// the queue is full
+	_, err = l.acquire(ctx, "role 'test'", 1, 1, time.Minute)
+	assertCodedError(t, http.StatusTooManyRequests, err)
+
+	// other keys are limited separately
+	releaseOther, err := l.acquire(ctx, "role 'other'", 1, 1, time.Minute)
+	assertErrorIsNil(t, err)
+	releaseOther()
+
+	release()
+	release = <-acquired
+	release()
+
+	// a limit of 0 does not limit requests
+	for i := 0; i < 10; i++ {
+		_, err := l.acquire(ctx, "role 'unlimited'", 0, 0, 0)
+		assertErrorIsNil(t, err)
+	}
+}
+
+func TestConcurrencyLimiterWait(t *testing.T) {
+	l := newConcurrencyLimiter()
+
+	release, err := l.acquire(context.Background(), "user pool 'eu-west-1_aaaa'", 1, 0, 0)
+	assertErrorIsNil(t, err)
+	defer release()
+
+	_, err = l.acquire(context.Background(), "user pool 'eu-west-1_aaaa'", 1, 0, 10*time.Millisecond)
+	assertCodedError(t, http.StatusTooManyRequests, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = l.acquire(ctx, "user pool 'eu-west-1_aaaa'", 1, 0, 0)
+	if err == nil {
+		t.Fatal("expected the request to time out")
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	equal(t, 0, l.semaphores["user pool 'eu-west-1_aaaa'"].waiting)
+}
+
+func TestCoalescer(t *testing.T) {
+	c := newCoalescer()
+
+	var calls int32
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	fn := func(ctx context.Context) (map[string]interface{}, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+		}
+		<-finish
+		return map[string]interface{}{"access_token": "AAAA"}, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([]map[string]interface{}, 5)
+	for i := range results {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data, shared, err := c.do(context.Background(), "key", fn)
+			if err != nil {
+				t.Error(err)
+			}
+			if shared != (i > 0) {
+				t.Errorf("expected only the first call not to be shared, call %d shared: %t", i, shared)
+			}
+			results[i] = data
+		}(i)
+		if i == 0 {
+			<-started
+		}
+	}
+
+	// wait for the other callers to join the running call
+	time.Sleep(50 * time.Millisecond)
+	close(finish)
+	wg.Wait()
+
+	equal(t, int32(1), atomic.LoadInt32(&calls))
+	for _, data := range results {
+		equal(t, "AAAA", data["access_token"])
+	}
+
+	// each caller gets its own copy
+	results[0]["access_token"] = "BBBB"
+	equal(t, "AAAA", results[1]["access_token"])
+
+	// calls that have finished are not shared
+	_, shared, err := c.do(context.Background(), "key", fn)
+	assertErrorIsNil(t, err)
+	equal(t, false, shared)
+	equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func waitForQueued(t *testing.T, l *concurrencyLimiter, key string, queued int) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		l.lock.Lock()
+		waiting := l.semaphores[key].waiting
+		l.lock.Unlock()
+		if waiting == queued {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("expected %d queued requests for %s", queued, key)
+}
+
+func assertCodedError(t *testing.T, code int, err error) {
+	t.Helper()
+
+	codedErr, ok := err.(logical.HTTPCodedError)
+	if !ok {
+		t.Fatalf("expected a coded error, actual: %v", err)
+	}
+	equal(t, code, codedErr.Code())
+}
@@ -0,0 +1,134 @@
+package cognito
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cognitoidentityprovider"
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// awsPermissionErrorCodes are returned when Vault's AWS credentials are missing,
+// invalid or not allowed to call an action
+var awsPermissionErrorCodes = []string{
+	"AccessDeniedException",
+	"UnrecognizedClientException",
+	"InvalidClientTokenId",
+	"ExpiredTokenException",
+	"ExpiredToken",
+	"SignatureDoesNotMatch",
+	"NoCredentialProviders",
+}
+
+// awsThrottlingErrorCodes are returned when AWS or Cognito are limiting requests
+var awsThrottlingErrorCodes = []string{
+	cognitoidentityprovider.ErrCodeTooManyRequestsException,
+	cognitoidentityprovider.ErrCodeLimitExceededException,
+	"ThrottlingException",
+	"Throttling",
+	"RequestLimitExceeded",
+}
+
+// awsUnavailableErrorCodes are returned when AWS or Cognito cannot be reached or
+// fail to handle the request
+var awsUnavailableErrorCodes = []string{
+	cognitoidentityprovider.ErrCodeInternalErrorException,
+	"ServiceUnavailable",
+	"ServiceUnavailableException",
+	request.ErrCodeRequestError,
+	request.ErrCodeResponseTimeout,
+	"RequestTimeout",
+	"RequestTimeoutException",
+}
+
+// awsConfigErrorCodes are returned when the role or the user pool is
+// misconfigured, and maps them to a hint of what to check
+var awsConfigErrorCodes = map[string]string{
+	cognitoidentityprovider.ErrCodeResourceNotFoundException:                "check the role's region, user_pool_id, app_client_id and groups",
+	cognitoidentityprovider.ErrCodeInvalidParameterException:                "check the role's settings, e.g. that the app client allows the ADMIN_NO_SRP_AUTH flow and that the user attributes exist in the user pool",
+	cognitoidentityprovider.ErrCodeInvalidPasswordException:                 "check that the role's password_policy satisfies the user pool's password policy",
+	cognitoidentityprovider.ErrCodeNotAuthorizedException:                   "check the role's app_client_id and app_client_secret, and that the app client allows the ADMIN_NO_SRP_AUTH flow",
+	cognitoidentityprovider.ErrCodeUsernameExistsException:                  "check that the role's username_template generates unique usernames",
+	cognitoidentityprovider.ErrCodeAliasExistsException:                     "check that the role's email_template generates unique email addresses",
+	cognitoidentityprovider.ErrCodeUserLambdaValidationException:            "a Lambda trigger of the user pool rejected the request",
+	cognitoidentityprovider.ErrCodeInvalidLambdaResponseException:           "check the Lambda triggers of the user pool",
+	cognitoidentityprovider.ErrCodeUnexpectedLambdaException:                "check the Lambda triggers of the user pool",
+	cognitoidentityprovider.ErrCodeInvalidUserPoolConfigurationException:    "check the configuration of the user pool",
+	cognitoidentityprovider.ErrCodeCodeDeliveryFailureException:             "check the role's send_invitation and the user pool's message delivery settings",
+	cognitoidentityprovider.ErrCodeInvalidEmailRoleAccessPolicyException:    "check the user pool's email configuration",
+	cognitoidentityprovider.ErrCodeInvalidSmsRoleAccessPolicyException:      "check the user pool's SMS configuration",
+	cognitoidentityprovider.ErrCodeInvalidSmsRoleTrustRelationshipException: "check the user pool's SMS configuration",
+	cognitoidentityprovider.ErrCodeUnsupportedUserStateException:            "check the role's provisioning_state",
+	cognitoidentityprovider.ErrCodeUserNotFoundException:                    "the user does not exist in the user pool",
+	cognitoidentityprovider.ErrCodeUnsupportedIdentityProviderException:     "check the role's provider_name",
+	cognitoidentityprovider.ErrCodeUserPoolAddOnNotEnabledException:         "check the user pool's advanced security settings",
+	cognitoidentityprovider.ErrCodeTooManyFailedAttemptsException:           "check the role's app_client_secret",
+	cognitoidentityprovider.ErrCodeInvalidOAuthFlowException:                "check the app client's OAuth flows",
+	cognitoidentityprovider.ErrCodePasswordResetRequiredException:           "the user must reset their password",
+	cognitoidentityprovider.ErrCodeUserNotConfirmedException:                "check the role's provisioning_state",
+	cognitoidentityprovider.ErrCodeConcurrentModificationException:          "the user pool was modified at the same time, retry the request",
+	cognitoidentityprovider.ErrCodeDuplicateProviderException:               "check the role's provider_name and provider_subject_template",
+	cognitoidentityprovider.ErrCodeUserImportInProgressException:            "a user import is in progress, retry once it has finished",
+}
+
+// checkActionErrorCodes are returned by calls for a user that does not exist
+// once the call has been authorised, see checkActions
+var checkActionErrorCodes = []string{
+	cognitoidentityprovider.ErrCodeUserNotFoundException,
+	cognitoidentityprovider.ErrCodeResourceNotFoundException,
+	cognitoidentityprovider.ErrCodeNotAuthorizedException,
+	cognitoidentityprovider.ErrCodeUserNotConfirmedException,
+	cognitoidentityprovider.ErrCodePasswordResetRequiredException,
+	cognitoidentityprovider.ErrCodeInvalidParameterException,
+	cognitoidentityprovider.ErrCodeInvalidPasswordException,
+}
+
+// awsError converts an error from an AWS API call into an error that Vault
+// reports with a status code that reflects the cause, with a message that says
+// what to check. action is the IAM action that was called, e.g.
+// cognito-idp:AdminCreateUser.
+//
+// Coded errors are used rather than logical.ErrPermissionDenied, as only the
+// status code and message of an error are passed from the plugin to Vault.
+func awsError(action string, message string, err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return errwrap.Wrapf(message+": {{err}}", err)
+	}
+
+	code := aerr.Code()
+	switch {
+	case code == "AccessDenied":
+		// STS returns AccessDenied when the role cannot be assumed
+		return logical.CodedError(http.StatusForbidden, fmt.Sprintf("%s: Vault's AWS credentials are not allowed to call sts:AssumeRole or %s, check the aws_assume_role_arn and the IAM policies: %s", message, action, err))
+	case strutil.StrListContains(awsPermissionErrorCodes, code):
+		return logical.CodedError(http.StatusForbidden, fmt.Sprintf("%s: Vault's AWS credentials are not allowed to call %s, check that the credentials are valid and that their IAM policy allows %s: %s", message, action, action, err))
+	case strutil.StrListContains(awsThrottlingErrorCodes, code):
+		return logical.CodedError(http.StatusTooManyRequests, fmt.Sprintf("%s: Cognito is throttling requests, retry after a few seconds: %s", message, err))
+	case strutil.StrListContains(awsUnavailableErrorCodes, code):
+		return logical.CodedError(http.StatusServiceUnavailable, fmt.Sprintf("%s: Cognito is unavailable, retry later: %s", message, err))
+	}
+
+	if hint, ok := awsConfigErrorCodes[code]; ok {
+		return logical.CodedError(http.StatusBadRequest, fmt.Sprintf("%s: %s: %s", message, hint, err))
+	}
+
+	return errwrap.Wrapf(message+": {{err}}", err)
+}
+
+// userNotDeletedError is returned by getNewUser when a user was created but
+// could not be provisioned, and deleting the user failed too. The user remains
+// in the user pool until its deletion is retried.
+type userNotDeletedError struct {
+	Username  string
+	Err       error
+	DeleteErr error
+}
+
+func (e *userNotDeletedError) Error() string {
+	return fmt.Sprintf("%s, and the created user %s could not be deleted: %s", e.Err, e.Username, e.DeleteErr)
+}
@@ -0,0 +1,90 @@
+package cognito
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestAWSError(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		code     int
+		contains string
+	}{
+		"access denied": {
+			err:      awserr.New("AccessDeniedException", "User is not authorized to perform: cognito-idp:AdminCreateUser", nil),
+			code:     http.StatusForbidden,
+			contains: "IAM policy allows cognito-idp:AdminCreateUser",
+		},
+		"assume role denied": {
+			err:      awserr.New("AccessDenied", "not authorized to perform: sts:AssumeRole", nil),
+			code:     http.StatusForbidden,
+			contains: "sts:AssumeRole",
+		},
+		"expired credentials": {
+			err:  awserr.New("ExpiredTokenException", "The security token included in the request is expired", nil),
+			code: http.StatusForbidden,
+		},
+		"throttled": {
+			err:      awserr.New("TooManyRequestsException", "Rate exceeded", nil),
+			code:     http.StatusTooManyRequests,
+			contains: "retry",
+		},
+		"unavailable": {
+			err:  awserr.New("InternalErrorException", "Internal error", nil),
+			code: http.StatusServiceUnavailable,
+		},
+		"network error": {
+			err:  awserr.New("RequestError", "send request failed", errors.New("connection reset")),
+			code: http.StatusServiceUnavailable,
+		},
+		"user pool not found": {
+			err:      awserr.New("ResourceNotFoundException", "User pool eu-west-1_aaaa does not exist.", nil),
+			code:     http.StatusBadRequest,
+			contains: "user_pool_id",
+		},
+		"invalid password": {
+			err:      awserr.New("InvalidPasswordException", "Password does not conform to policy", nil),
+			code:     http.StatusBadRequest,
+			contains: "password_policy",
+		},
+		"not authorized": {
+			err:      awserr.New("NotAuthorizedException", "Unable to verify secret hash for client", nil),
+			code:     http.StatusBadRequest,
+			contains: "app_client_secret",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			err := awsError("cognito-idp:AdminCreateUser", "Could not create user", test.err)
+
+			codedErr, ok := err.(logical.HTTPCodedError)
+			if !ok {
+				t.Fatalf("expected a coded error, actual: %#v", err)
+			}
+			equal(t, test.code, codedErr.Code())
+
+			if !strings.HasPrefix(err.Error(), "Could not create user: ") || !strings.Contains(err.Error(), test.contains) {
+				t.Fatalf("unexpected error message: %s", err)
+			}
+		})
+	}
+
+	t.Run("unknown errors are wrapped", func(t *testing.T) {
+		for _, cause := range []error{errors.New("boom"), awserr.New("SomethingNew", "boom", nil)} {
+			err := awsError("cognito-idp:AdminCreateUser", "Could not create user", cause)
+			if _, ok := err.(logical.HTTPCodedError); ok {
+				t.Fatalf("expected an uncoded error, actual: %#v", err)
+			}
+			if !strings.HasPrefix(err.Error(), "Could not create user: ") {
+				t.Fatalf("unexpected error message: %s", err)
+			}
+		}
+	})
+}
@@ -2,7 +2,9 @@ package cognito
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"strings"
 	"testing"
 
@@ -81,3 +83,16 @@ func fakeSaveLoad(s *logical.Secret) {
 		panic(err)
 	}
 }
+
+// failingStorage fails to write the entries whose keys have the prefix
+type failingStorage struct {
+	logical.Storage
+	prefix string
+}
+
+func (s *failingStorage) Put(ctx context.Context, entry *logical.StorageEntry) error {
+	if strings.HasPrefix(entry.Key, s.prefix) {
+		return errors.New("storage unavailable")
+	}
+	return s.Storage.Put(ctx, entry)
+}
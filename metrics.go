@@ -0,0 +1,135 @@
+package cognito
+
+import (
+	"net/http"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// metricsPrefix prefixes the keys of the metrics emitted by the plugin
+var metricsPrefix = []string{"cognito"}
+
+func metricKey(parts ...string) []string {
+	return append(append([]string{}, metricsPrefix...), parts...)
+}
+
+func roleLabels(roleName string, credentialType string) []metrics.Label {
+	return []metrics.Label{
+		{Name: "role", Value: roleName},
+		{Name: "credential_type", Value: credentialType},
+	}
+}
+
+// recordCreds counts a creds request as issued or failed and records how long
+// it took, failures are labelled with the class of error
+func recordCreds(roleName string, credentialType string, start time.Time, resp *logical.Response, err error) {
+	labels := roleLabels(roleName, credentialType)
+
+	if err == nil && (resp == nil || !resp.IsError()) {
+		metrics.IncrCounterWithLabels(metricKey("creds", "issued"), 1, labels)
+		metrics.MeasureSinceWithLabels(metricKey("creds", "time"), start, labels)
+		return
+	}
+
+	labels = append(labels, metrics.Label{Name: "error_class", Value: errorClass(err)})
+	metrics.IncrCounterWithLabels(metricKey("creds", "failed"), 1, labels)
+}
+
+// errorClass classifies the error of a failed request by the status code that
+// it is reported with, see awsError. A request without an error failed with an
+// error response, i.e. it was invalid.
+func errorClass(err error) string {
+	if err == nil {
+		return "invalid_request"
+	}
+
+	codedErr, ok := err.(logical.HTTPCodedError)
+	if !ok {
+		return "internal"
+	}
+
+	switch codedErr.Code() {
+	case http.StatusBadRequest:
+		return "config"
+	case http.StatusForbidden:
+		return "permission"
+	case http.StatusTooManyRequests:
+		return "throttled"
+	case http.StatusServiceUnavailable:
+		return "unavailable"
+	default:
+		return "internal"
+	}
+}
+
+// recordTokenCoalesced counts a client credentials request that shared the
+// token of a concurrent identical request
+func recordTokenCoalesced(roleName string, credentialType string) {
+	metrics.IncrCounterWithLabels(metricKey("token", "coalesced"), 1, roleLabels(roleName, credentialType))
+}
+
+// recordRenew counts a renewed user lease
+func recordRenew(roleName string) {
+	metrics.IncrCounterWithLabels(metricKey("renew"), 1, roleLabels(roleName, credentialTypeUser))
+}
+
+// recordRevoke counts a revoked user lease, and a failed deletion of the user
+// if deleteErr is set, e.g. when the deletion is queued to be retried
+func recordRevoke(roleName string, deleteErr error) {
+	labels := roleLabels(roleName, credentialTypeUser)
+	metrics.IncrCounterWithLabels(metricKey("revoke"), 1, labels)
+
+	if deleteErr != nil {
+		labels = append(labels, metrics.Label{Name: "error_class", Value: errorClass(deleteErr)})
+		metrics.IncrCounterWithLabels(metricKey("revoke", "failed"), 1, labels)
+	}
+}
+
+// recordRevocationRetry counts a retried deletion of a user whose lease has
+// been revoked, and whether it failed again
+func recordRevocationRetry(roleName string, deleteErr error) {
+	labels := roleLabels(roleName, credentialTypeUser)
+	metrics.IncrCounterWithLabels(metricKey("revoke", "retry"), 1, labels)
+
+	if deleteErr != nil {
+		labels = append(labels, metrics.Label{Name: "error_class", Value: errorClass(deleteErr)})
+		metrics.IncrCounterWithLabels(metricKey("revoke", "retry", "failed"), 1, labels)
+	}
+}
+
+// recordAPICall records the latency of an AWS API call, including its retries,
+// and counts failed calls by error code. It runs as a Complete handler of the
+// AWS session, so it records both Cognito and STS calls.
+func recordAPICall(r *request.Request) {
+	labels := []metrics.Label{
+		{Name: "service", Value: r.ClientInfo.ServiceName},
+		{Name: "operation", Value: r.Operation.Name},
+	}
+	metrics.MeasureSinceWithLabels(metricKey("api", "time"), r.Time, labels)
+
+	if r.Error != nil {
+		code := "unknown"
+		if aerr, ok := r.Error.(awserr.Error); ok {
+			code = aerr.Code()
+		}
+		metrics.IncrCounterWithLabels(metricKey("api", "error"), 1, append(labels, metrics.Label{Name: "code", Value: code}))
+	}
+}
+
+// recordTokenRequest records the latency of a request to the token endpoint,
+// including its retries, and counts failed requests
+func recordTokenRequest(start time.Time, err error) {
+	labels := []metrics.Label{
+		{Name: "service", Value: "cognito-oauth2"},
+		{Name: "operation", Value: "ClientCredentials"},
+	}
+	metrics.MeasureSinceWithLabels(metricKey("api", "time"), start, labels)
+
+	if err != nil {
+		metrics.IncrCounterWithLabels(metricKey("api", "error"), 1, append(labels, metrics.Label{Name: "code", Value: errorClass(err)}))
+	}
+}
@@ -0,0 +1,86 @@
+package cognito
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	metrics "github.com/armon/go-metrics"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestMetrics(t *testing.T) {
+	sink := metrics.NewInmemSink(time.Minute, time.Minute)
+	config := metrics.DefaultConfig("")
+	config.EnableHostname = false
+	config.EnableRuntimeMetrics = false
+	_, err := metrics.NewGlobal(config, sink)
+	assertErrorIsNil(t, err)
+	defer metrics.NewGlobal(config, &metrics.BlackholeSink{})
+
+	b, s := getTestBackend(t, true)
+	mc := b.client.(*mockClient)
+
+	testRoleCreate(t, b, s, "test_role", map[string]interface{}{
+		"credential_type": "user",
+		"app_client_id":   "testAppClientId",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaa",
+		"group":           "testGroup",
+	})
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/test_role",
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+
+	mc.newUserErr = logical.CodedError(http.StatusTooManyRequests, "Cognito is throttling requests")
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/test_role",
+		Storage:   s,
+	})
+	if err == nil {
+		t.Fatal("expected the creds request to fail")
+	}
+
+	counters := sink.Data()[0].Counters
+	expected := map[string]int{
+		"cognito.creds.issued;role=test_role;credential_type=user":                       1,
+		"cognito.creds.failed;role=test_role;credential_type=user;error_class=throttled": 1,
+		"cognito.revoke;role=test_role;credential_type=user":                             1,
+	}
+	for key, count := range expected {
+		counter, ok := counters[key]
+		if !ok {
+			t.Fatalf("expected counter %s, actual counters: %v", key, counters)
+		}
+		equal(t, count, counter.Count)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	tests := map[string]error{
+		"invalid_request": nil,
+		"config":          logical.CodedError(http.StatusBadRequest, "check the role"),
+		"permission":      logical.CodedError(http.StatusForbidden, "access denied"),
+		"throttled":       logical.CodedError(http.StatusTooManyRequests, "throttled"),
+		"unavailable":     logical.CodedError(http.StatusServiceUnavailable, "unavailable"),
+		"internal":        errors.New("storage failed"),
+	}
+
+	for expected, err := range tests {
+		equal(t, expected, errorClass(err))
+	}
+}
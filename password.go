@@ -0,0 +1,113 @@
+package cognito
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+)
+
+const (
+	passwordUppercase = "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	passwordLowercase = "abcdefghijklmnopqrstuvwxyz"
+	passwordNumbers   = "0123456789"
+	// passwordSymbols are a subset of the special characters accepted by Cognito
+	passwordSymbols = "~=+%^*/()[]{}!@#$?|"
+
+	defaultPasswordLength = 32
+)
+
+// passwordPolicy is the password policy of a Cognito user pool
+type passwordPolicy struct {
+	MinimumLength    int
+	RequireUppercase bool
+	RequireLowercase bool
+	RequireNumbers   bool
+	RequireSymbols   bool
+}
+
+// generatePassword generates a random password using crypto/rand that satisfies
+// the given user pool password policy. The password always contains at least
+// one character from each character class so that it satisfies any policy.
+func generatePassword(policy passwordPolicy) (string, error) {
+	length := defaultPasswordLength
+	if policy.MinimumLength > length {
+		length = policy.MinimumLength
+	}
+
+	classes := []string{passwordUppercase, passwordLowercase, passwordNumbers, passwordSymbols}
+	all := strings.Join(classes, "")
+
+	buf := make([]byte, length)
+	for i := range buf {
+		charset := all
+		if i < len(classes) {
+			charset = classes[i]
+		}
+
+		c, err := randomChar(charset)
+		if err != nil {
+			return "", err
+		}
+		buf[i] = c
+	}
+
+	// shuffle so that the required characters are not always at the start
+	for i := len(buf) - 1; i > 0; i-- {
+		j, err := randomInt(i + 1)
+		if err != nil {
+			return "", err
+		}
+		buf[i], buf[j] = buf[j], buf[i]
+	}
+
+	return string(buf), nil
+}
+
+// check verifies that a password satisfies the password policy
+func (p passwordPolicy) check(password string) error {
+	if len(password) < p.MinimumLength {
+		return fmt.Errorf("password must be at least %d characters", p.MinimumLength)
+	}
+
+	if p.RequireUppercase && !strings.ContainsAny(password, passwordUppercase) {
+		return fmt.Errorf("password must contain an uppercase character")
+	}
+
+	if p.RequireLowercase && !strings.ContainsAny(password, passwordLowercase) {
+		return fmt.Errorf("password must contain a lowercase character")
+	}
+
+	if p.RequireNumbers && !strings.ContainsAny(password, passwordNumbers) {
+		return fmt.Errorf("password must contain a number")
+	}
+
+	if p.RequireSymbols && strings.IndexFunc(password, isCognitoSymbol) < 0 {
+		return fmt.Errorf("password must contain a special character")
+	}
+
+	return nil
+}
+
+// isCognitoSymbol reports whether r is one of the special characters accepted by Cognito
+func isCognitoSymbol(r rune) bool {
+	return strings.ContainsRune("^$*.[]{}()?\"!@#%&/\\,><':;|_~`=+- ", r)
+}
+
+func randomChar(charset string) (byte, error) {
+	i, err := randomInt(len(charset))
+	if err != nil {
+		return 0, err
+	}
+	return charset[i], nil
+}
+
+func randomInt(max int) (int, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(int64(max)))
+	if err != nil {
+		return 0, errwrap.Wrapf("unable to generate random number: {{err}}", err)
+	}
+	return int(n.Int64()), nil
+}
@@ -0,0 +1,63 @@
+package cognito
+
+import (
+	"testing"
+)
+
+func TestGeneratePassword(t *testing.T) {
+	policies := []passwordPolicy{
+		{},
+		{MinimumLength: 8, RequireUppercase: true, RequireLowercase: true, RequireNumbers: true, RequireSymbols: true},
+		{MinimumLength: 64, RequireSymbols: true},
+	}
+
+	for i, policy := range policies {
+		password, err := generatePassword(policy)
+		assertErrorIsNil(t, err)
+
+		if err := policy.check(password); err != nil {
+			t.Fatalf("\ncase %d\npassword does not satisfy policy: %s", i, err)
+		}
+
+		if len(password) < defaultPasswordLength {
+			t.Fatalf("\ncase %d\nexpected at least %d characters, actual: %d", i, defaultPasswordLength, len(password))
+		}
+	}
+
+	// verify passwords are not repeated
+	a, _ := generatePassword(passwordPolicy{})
+	b, _ := generatePassword(passwordPolicy{})
+	if a == b {
+		t.Fatalf("expected different passwords, actual: %s and %s", a, b)
+	}
+}
+
+func TestPasswordPolicyCheck(t *testing.T) {
+	policy := passwordPolicy{
+		MinimumLength:    8,
+		RequireUppercase: true,
+		RequireLowercase: true,
+		RequireNumbers:   true,
+		RequireSymbols:   true,
+	}
+
+	tests := []struct {
+		password string
+		expError bool
+	}{
+		{"Aa1!aaaa", false},
+		{"Aa1 aaaa", false},
+		{"Aa1!aaa", true},
+		{"aa1!aaaa", true},
+		{"AA1!AAAA", true},
+		{"Aaa!aaaa", true},
+		{"Aa1aaaaa", true},
+	}
+
+	for i, test := range tests {
+		err := policy.check(test.password)
+		if (err != nil) != test.expError {
+			t.Fatalf("\ncase %d\nexp error: %t\ngot: %v", i, test.expError, err)
+		}
+	}
+}
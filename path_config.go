@@ -3,23 +3,70 @@ package cognito
 import (
 	"context"
 	"errors"
+	"math"
+	"time"
+
+	"github.com/hashicorp/errwrap"
 	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
 	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/time/rate"
 )
 
 const (
 	configStoragePath = "config"
+
+	// defaultMaxRetries is the number of times a failed or throttled request to
+	// AWS or the token endpoint is retried if max_retries is not set
+	defaultMaxRetries = 3
 )
 
 // cognitoConfig contains values to configure cognito clients and
 // defaults for roles. The zero value is useful and results in
 // environments variable and system defaults being used.
 type cognitoConfig struct {
-	AwsAccessKeyId     string `json:"aws_access_key_id"`
-	AwsAssumeRoleArn   string `json:"aws_assume_role_arn"`
-	AwsSecretAccessKey string `json:"aws_secret_access_key"`
-	AwsSessionToken    string `json:"aws_session_token"`
+	AwsAccessKeyId     string        `json:"aws_access_key_id"`
+	AwsAssumeRoleArn   string        `json:"aws_assume_role_arn"`
+	AwsSecretAccessKey string        `json:"aws_secret_access_key"`
+	AwsSessionToken    string        `json:"aws_session_token"`
+	TidyInterval       time.Duration `json:"tidy_interval"`
+	TidySafetyBuffer   time.Duration `json:"tidy_safety_buffer"`
+	// MaxRetries is a pointer so that 0, which disables retries, can be told
+	// apart from a config saved before retries were configurable
+	MaxRetries     *int          `json:"max_retries,omitempty"`
+	MinRetryDelay  time.Duration `json:"min_retry_delay"`
+	MaxRetryDelay  time.Duration `json:"max_retry_delay"`
+	RateLimit      float64       `json:"rate_limit"`
+	RateLimitBurst int           `json:"rate_limit_burst"`
+	// MaxConcurrentRequestsPerRole and MaxConcurrentRequestsPerPool limit the
+	// number of creds requests that run at once, 0 does not limit requests
+	MaxConcurrentRequestsPerRole int           `json:"max_concurrent_requests_per_role"`
+	MaxConcurrentRequestsPerPool int           `json:"max_concurrent_requests_per_pool"`
+	MaxQueuedRequests            int           `json:"max_queued_requests"`
+	MaxQueueWait                 time.Duration `json:"max_queue_wait"`
+}
+
+// maxRetries returns the number of times a failed request is retried
+func (c *cognitoConfig) maxRetries() int {
+	if c.MaxRetries == nil {
+		return defaultMaxRetries
+	}
+	return *c.MaxRetries
+}
+
+// rateLimit returns the limit and burst of the requests made to AWS and the
+// token endpoint, an unset rate limit does not limit requests.
+func (c *cognitoConfig) rateLimit() (rate.Limit, int) {
+	if c.RateLimit <= 0 {
+		return rate.Inf, 0
+	}
+
+	burst := c.RateLimitBurst
+	if burst <= 0 {
+		burst = int(math.Ceil(c.RateLimit))
+	}
+	return rate.Limit(c.RateLimit), burst
 }
 
 func pathConfig(b *cognitoSecretBackend) *framework.Path {
@@ -42,6 +89,50 @@ func pathConfig(b *cognitoSecretBackend) *framework.Path {
 				Type:        framework.TypeString,
 				Description: `The AWS session token for accessing the AWS API (Optional).`,
 			},
+			"tidy_interval": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: `How often to automatically tidy orphaned users, if not set or set to 0 automatic tidy is disabled (Optional).`,
+			},
+			"tidy_safety_buffer": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: `The minimum age of an untracked user before automatic tidy deletes it, defaults to 1 hour (Optional).`,
+			},
+			"max_retries": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: `The number of times a throttled or failed request to AWS or the token endpoint is retried, defaults to 3, set to 0 to disable retries (Optional).`,
+			},
+			"min_retry_delay": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: `The delay before the first retry, doubled with each retry, e.g. "100ms". Defaults to 30ms, or 500ms for throttled requests (Optional).`,
+			},
+			"max_retry_delay": &framework.FieldSchema{
+				Type:        framework.TypeString,
+				Description: `The maximum delay between retries, e.g. "10s". Defaults to 5 minutes (Optional).`,
+			},
+			"rate_limit": &framework.FieldSchema{
+				Type:        framework.TypeFloat,
+				Description: `The maximum number of requests per second made to AWS and the token endpoint, including retries. If not set or set to 0 requests are not limited (Optional).`,
+			},
+			"rate_limit_burst": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: `The number of requests that can be made at once before rate_limit applies, defaults to rate_limit rounded up (Optional).`,
+			},
+			"max_concurrent_requests_per_role": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: `The maximum number of creds requests for a role that run at once, further requests are queued. If not set or set to 0 requests are not limited (Optional).`,
+			},
+			"max_concurrent_requests_per_pool": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: `The maximum number of creds requests for a user pool, or for a token endpoint, that run at once, further requests are queued. If not set or set to 0 requests are not limited (Optional).`,
+			},
+			"max_queued_requests": &framework.FieldSchema{
+				Type:        framework.TypeInt,
+				Description: `The maximum number of creds requests queued for a role or a user pool, further requests fail with a 429 status code. If not set or set to 0 the queue is not bounded (Optional).`,
+			},
+			"max_queue_wait": &framework.FieldSchema{
+				Type:        framework.TypeDurationSecond,
+				Description: `How long a queued creds request waits before failing with a 429 status code. If not set or set to 0 requests wait until they time out (Optional).`,
+			},
 		},
 		Callbacks: map[logical.Operation]framework.OperationFunc{
 			logical.CreateOperation: b.pathConfigWrite,
@@ -85,6 +176,77 @@ func (b *cognitoSecretBackend) pathConfigWrite(ctx context.Context, req *logical
 		config.AwsSessionToken = awsSessionToken.(string)
 	}
 
+	if tidyInterval, ok := data.GetOk("tidy_interval"); ok {
+		config.TidyInterval = time.Duration(tidyInterval.(int)) * time.Second
+	}
+
+	if tidySafetyBuffer, ok := data.GetOk("tidy_safety_buffer"); ok {
+		config.TidySafetyBuffer = time.Duration(tidySafetyBuffer.(int)) * time.Second
+	}
+
+	if config.TidyInterval < 0 || config.TidySafetyBuffer < 0 {
+		merr = multierror.Append(merr, errors.New("tidy_interval and tidy_safety_buffer cannot be negative"))
+	}
+
+	if maxRetries, ok := data.GetOk("max_retries"); ok {
+		maxRetries := maxRetries.(int)
+		config.MaxRetries = &maxRetries
+	}
+
+	if minRetryDelay, ok := data.GetOk("min_retry_delay"); ok {
+		config.MinRetryDelay, err = parseutil.ParseDurationSecond(minRetryDelay)
+		if err != nil {
+			merr = multierror.Append(merr, errwrap.Wrapf("invalid min_retry_delay: {{err}}", err))
+		}
+	}
+
+	if maxRetryDelay, ok := data.GetOk("max_retry_delay"); ok {
+		config.MaxRetryDelay, err = parseutil.ParseDurationSecond(maxRetryDelay)
+		if err != nil {
+			merr = multierror.Append(merr, errwrap.Wrapf("invalid max_retry_delay: {{err}}", err))
+		}
+	}
+
+	if rateLimit, ok := data.GetOk("rate_limit"); ok {
+		config.RateLimit = rateLimit.(float64)
+	}
+
+	if rateLimitBurst, ok := data.GetOk("rate_limit_burst"); ok {
+		config.RateLimitBurst = rateLimitBurst.(int)
+	}
+
+	if config.maxRetries() < 0 || config.MinRetryDelay < 0 || config.MaxRetryDelay < 0 {
+		merr = multierror.Append(merr, errors.New("max_retries, min_retry_delay and max_retry_delay cannot be negative"))
+	}
+
+	if config.MinRetryDelay > 0 && config.MaxRetryDelay > 0 && config.MinRetryDelay > config.MaxRetryDelay {
+		merr = multierror.Append(merr, errors.New("min_retry_delay cannot be greater than max_retry_delay"))
+	}
+
+	if config.RateLimit < 0 || config.RateLimitBurst < 0 {
+		merr = multierror.Append(merr, errors.New("rate_limit and rate_limit_burst cannot be negative"))
+	}
+
+	if maxConcurrentRequestsPerRole, ok := data.GetOk("max_concurrent_requests_per_role"); ok {
+		config.MaxConcurrentRequestsPerRole = maxConcurrentRequestsPerRole.(int)
+	}
+
+	if maxConcurrentRequestsPerPool, ok := data.GetOk("max_concurrent_requests_per_pool"); ok {
+		config.MaxConcurrentRequestsPerPool = maxConcurrentRequestsPerPool.(int)
+	}
+
+	if maxQueuedRequests, ok := data.GetOk("max_queued_requests"); ok {
+		config.MaxQueuedRequests = maxQueuedRequests.(int)
+	}
+
+	if maxQueueWait, ok := data.GetOk("max_queue_wait"); ok {
+		config.MaxQueueWait = time.Duration(maxQueueWait.(int)) * time.Second
+	}
+
+	if config.MaxConcurrentRequestsPerRole < 0 || config.MaxConcurrentRequestsPerPool < 0 || config.MaxQueuedRequests < 0 || config.MaxQueueWait < 0 {
+		merr = multierror.Append(merr, errors.New("max_concurrent_requests_per_role, max_concurrent_requests_per_pool, max_queued_requests and max_queue_wait cannot be negative"))
+	}
+
 	if merr.ErrorOrNil() != nil {
 		return logical.ErrorResponse(merr.Error()), nil
 	}
@@ -3,8 +3,11 @@ package cognito
 import (
 	"context"
 	"testing"
+	"time"
 
+	awsclient "github.com/aws/aws-sdk-go/aws/client"
 	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/time/rate"
 )
 
 func testConfigCreate(t *testing.T, b logical.Backend, s logical.Storage, d map[string]interface{}) {
@@ -31,3 +34,130 @@ func testConfigCreateUpdate(t *testing.T, b logical.Backend, op logical.Operatio
 		t.Fatal(resp.Error())
 	}
 }
+
+func TestConfigRetries(t *testing.T) {
+	b, s := getTestBackend(t, false)
+
+	testConfigCreate(t, b, s, map[string]interface{}{
+		"max_retries":     5,
+		"min_retry_delay": "100ms",
+		"max_retry_delay": "10s",
+		"rate_limit":      2.5,
+	})
+
+	c, err := b.getClient(context.Background(), &logical.Request{Storage: s})
+	assertErrorIsNil(t, err)
+	client := c.(*clientImpl)
+	equal(t, 5, client.MaxRetries)
+	equal(t, 100*time.Millisecond, client.MinRetryDelay)
+	equal(t, 10*time.Second, client.MaxRetryDelay)
+	equal(t, rate.Limit(2.5), client.Limiter.Limit())
+	equal(t, 3, client.Limiter.Burst())
+
+	retryer := client.retryer()
+	equal(t, 5, retryer.NumMaxRetries)
+	equal(t, 100*time.Millisecond, retryer.MinThrottleDelay)
+	equal(t, 10*time.Second, retryer.MaxThrottleDelay)
+
+	// retries can be disabled and the rate limit removed
+	testConfigCreateUpdate(t, b, logical.UpdateOperation, s, map[string]interface{}{
+		"max_retries": 0,
+		"rate_limit":  0,
+	})
+
+	c, err = b.getClient(context.Background(), &logical.Request{Storage: s})
+	assertErrorIsNil(t, err)
+	client = c.(*clientImpl)
+	equal(t, 0, client.MaxRetries)
+	equal(t, rate.Inf, client.Limiter.Limit())
+}
+
+func TestConfigRetriesDefault(t *testing.T) {
+	b, s := getTestBackend(t, false)
+
+	testConfigCreate(t, b, s, map[string]interface{}{})
+
+	c, err := b.getClient(context.Background(), &logical.Request{Storage: s})
+	assertErrorIsNil(t, err)
+	client := c.(*clientImpl)
+	equal(t, defaultMaxRetries, client.MaxRetries)
+	equal(t, rate.Inf, client.Limiter.Limit())
+
+	retryer := client.retryer()
+	equal(t, awsclient.DefaultRetryerMinRetryDelay, retryer.MinRetryDelay)
+	equal(t, awsclient.DefaultRetryerMaxThrottleDelay, retryer.MaxThrottleDelay)
+}
+
+func TestConfigRetriesValidation(t *testing.T) {
+	tests := map[string]map[string]interface{}{
+		"negative max_retries":      {"max_retries": -1},
+		"invalid min_retry_delay":   {"min_retry_delay": "soon"},
+		"min greater than max":      {"min_retry_delay": "10s", "max_retry_delay": "1s"},
+		"negative rate_limit":       {"rate_limit": -1},
+		"negative rate_limit_burst": {"rate_limit_burst": -1},
+	}
+
+	for name, data := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, s := getTestBackend(t, false)
+
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.CreateOperation,
+				Path:      "config",
+				Data:      data,
+				Storage:   s,
+			})
+			assertErrorIsNil(t, err)
+			if resp == nil || !resp.IsError() {
+				t.Fatalf("expected an error response, actual: %#v", resp)
+			}
+		})
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	retryer := awsclient.DefaultRetryer{
+		MinRetryDelay:    100 * time.Millisecond,
+		MaxRetryDelay:    time.Second,
+		MinThrottleDelay: time.Second,
+		MaxThrottleDelay: 5 * time.Second,
+	}
+
+	tests := []struct {
+		attempt   int
+		throttled bool
+		max       time.Duration
+	}{
+		{0, false, 100 * time.Millisecond},
+		{2, false, 400 * time.Millisecond},
+		{10, false, time.Second},
+		{0, true, time.Second},
+		{10, true, 5 * time.Second},
+	}
+
+	for _, test := range tests {
+		for i := 0; i < 10; i++ {
+			delay := retryDelay(retryer, test.attempt, test.throttled)
+			if delay < test.max/2 || delay > test.max {
+				t.Fatalf("expected a delay between %s and %s for attempt %d, actual: %s", test.max/2, test.max, test.attempt, delay)
+			}
+		}
+	}
+}
+
+func TestConfigInvalidate(t *testing.T) {
+	b, _ := getTestBackend(t, false)
+
+	// role changes do not clear the client
+	b.Invalidate(context.Background(), "roles/test_role")
+	if b.client == nil {
+		t.Fatal("expected the client to be kept")
+	}
+
+	// config replicated from another node clears the client, so that it is
+	// rebuilt with the new credentials
+	b.Invalidate(context.Background(), "config")
+	if b.client != nil {
+		t.Fatalf("expected the client to be cleared, actual: %#v", b.client)
+	}
+}
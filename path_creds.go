@@ -4,14 +4,36 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"regexp"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/errwrap"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/parseutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
 const (
 	SecretTypeUser = "user"
+
+	usersStoragePath = "users"
 )
 
+// userEntry records a user created by this backend that has an active lease
+type userEntry struct {
+	Username   string    `json:"username"`
+	Role       string    `json:"role"`
+	Region     string    `json:"region"`
+	UserPoolId string    `json:"user_pool_id"`
+	EntityID   string    `json:"entity_id"`
+	CreateTime time.Time `json:"create_time"`
+	// ExpireTime is when the lease is expected to expire, it is updated when the
+	// lease is renewed
+	ExpireTime time.Time `json:"expire_time"`
+}
+
 func secretUser(b *cognitoSecretBackend) *framework.Secret {
 	return &framework.Secret{
 		Type:   SecretTypeUser,
@@ -28,6 +50,22 @@ func pathCreds(b *cognitoSecretBackend) *framework.Path {
 				Type:        framework.TypeLowerCaseString,
 				Description: "Name of the Vault role",
 			},
+			"groups": {
+				Type:        framework.TypeCommaStringSlice,
+				Description: fmt.Sprintf("The groups to add the created user to, these must be allowed by the role, defaults to the role's groups (for %s)", credentialTypeUser),
+			},
+			"ttl": {
+				Type:        framework.TypeDurationSecond,
+				Description: fmt.Sprintf("The lease for the created user, this cannot be greater than the role's max_ttl, defaults to the role's ttl (for %s)", credentialTypeUser),
+			},
+			"attributes": {
+				Type:        framework.TypeKVPairs,
+				Description: fmt.Sprintf("Additional user attributes to set on the created user, these must be in the role's allowed_attributes (for %s)", credentialTypeUser),
+			},
+			"username_suffix": {
+				Type:        framework.TypeString,
+				Description: fmt.Sprintf("A suffix to add to the username, this cannot be longer than the role's max_username_suffix_length (for %s)", credentialTypeUser),
+			},
 		},
 		Operations: map[logical.Operation]framework.OperationHandler{
 			logical.ReadOperation: &framework.PathOperation{
@@ -35,6 +73,11 @@ func pathCreds(b *cognitoSecretBackend) *framework.Path {
 				ForwardPerformanceSecondary: true,
 				ForwardPerformanceStandby:   true,
 			},
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.pathCredsRead,
+				ForwardPerformanceSecondary: true,
+				ForwardPerformanceStandby:   true,
+			},
 		},
 
 		HelpSynopsis:    pathCredsHelpSyn,
@@ -43,7 +86,7 @@ func pathCreds(b *cognitoSecretBackend) *framework.Path {
 }
 
 // pathCredsRead generates cognito access tokens based on the role credential type.
-func (b *cognitoSecretBackend) pathCredsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+func (b *cognitoSecretBackend) pathCredsRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (resp *logical.Response, err error) {
 
 	roleName := d.Get("role").(string)
 
@@ -56,24 +99,230 @@ func (b *cognitoSecretBackend) pathCredsRead(ctx context.Context, req *logical.R
 		return logical.ErrorResponse(fmt.Sprintf("role '%s' does not exist", roleName)), nil
 	}
 
-	client, _ := b.getClient(ctx, req)
+	defer func(start time.Time) {
+		recordCreds(roleName, role.CredentialType, start, resp, err)
+	}(time.Now())
+
+	client, err := b.getClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
 	if role.CredentialType == credentialTypeUser {
-		rawData, err := client.getNewUser(role.Region, role.AppClientId, role.UserPoolId, role.Group, role.DummyEmailDomain)
+		userReq, errResp := parseUserRequest(d, roleName, role, b.System().MaxLeaseTTL())
+		if errResp != nil {
+			return errResp, nil
+		}
+
+		release, err := b.acquireCredsSlots(ctx, req.Storage, roleName, fmt.Sprintf("user pool '%s'", role.UserPoolId))
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+
+		templateData, err := b.newTemplateData(req, roleName, role)
+		if err != nil {
+			return nil, err
+		}
+		templateData.UsernameSuffix = userReq.UsernameSuffix
+
+		ttl := role.TTL
+		if userReq.TTL > 0 {
+			ttl = userReq.TTL
+		}
+
+		expiresAt := b.leaseExpiry(role, ttl, time.Now())
+		templateData.TTL = int64(ttl / time.Second)
+		templateData.ExpiresAt = expiresAt.Format(time.RFC3339)
+
+		userPool, err := client.getUserPool(ctx, role.Region, role.UserPoolId)
 		if err != nil {
 			return nil, err
 		}
 
+		email, username, err := generateUsername(role, templateData)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		var phoneNumber string
+		if userPool.usesAttribute(attributePhoneNumber) {
+			phoneNumber, err = generatePhoneNumber(role, templateData)
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+
+		username = userPool.poolUsername(username, email, phoneNumber)
+		templateData.Username = username
+
+		password, err := b.newPassword(ctx, role, userPool)
+		if err != nil {
+			return nil, err
+		}
+
+		userAttributes, err := renderTemplates(role.UserAttributes, templateData)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		// the email is only set when the user pool uses it or the role configures it,
+		// so that pools which identify users by phone number are not sent a dummy email
+		userEmail := email
+		if !userPool.usesAttribute(attributeEmail) && !role.setsEmail() {
+			userEmail = ""
+		}
+
+		attributes := userPool.identityAttributes(username, userEmail, phoneNumber)
+		for name, value := range userAttributes {
+			attributes[name] = value
+		}
+
+		for name, value := range userReq.Attributes {
+			attributes[name] = value
+		}
+
+		for name, value := range metadataAttributes(req, roleName, role, expiresAt) {
+			attributes[name] = value
+		}
+
+		if err := userPool.checkRequiredAttributes(attributes); err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		clientMetadata, err := renderTemplates(role.ClientMetadata, templateData)
+		if err != nil {
+			return logical.ErrorResponse(err.Error()), nil
+		}
+
+		var providerSubject string
+		if role.ProviderName != "" {
+			providerSubject, err = generateProviderSubject(role, templateData)
+			if err != nil {
+				return logical.ErrorResponse(err.Error()), nil
+			}
+		}
+
+		if err := b.reserveUser(ctx, req.Storage, roleName, role); err != nil {
+			return nil, err
+		}
+
+		rawData, err := client.getNewUser(ctx, &newUserInput{
+			Region:      role.Region,
+			AppClientId: role.AppClientId,
+			UserPoolId:  role.UserPoolId,
+			Groups:      userReq.Groups,
+			Username:    username,
+			Password:    password,
+			Attributes:  attributes,
+
+			ClientMetadata:    clientMetadata,
+			AppClientSecret:   role.AppClientSecret,
+			ProvisioningState: role.provisioningState(),
+			SendInvitation:    role.SendInvitation,
+
+			ProviderName:          role.ProviderName,
+			ProviderAttributeName: providerAttributeName(role),
+			ProviderSubject:       providerSubject,
+		})
+		if err != nil {
+			// a user that was created but could not be provisioned or deleted is
+			// queued for revocation, so that it does not remain in the user pool
+			created := false
+			var notDeleted *userNotDeletedError
+			if errors.As(err, &notDeleted) {
+				created = true
+				b.Logger().Error("failed to delete partly created user, queueing for retry", "username", notDeleted.Username, "error", notDeleted.DeleteErr)
+				revocation := &revocationEntry{
+					Username:   notDeleted.Username,
+					Role:       roleName,
+					Region:     role.Region,
+					UserPoolId: role.UserPoolId,
+				}
+				if queueErr := queueRevocation(ctx, req.Storage, revocation, notDeleted.DeleteErr, time.Now()); queueErr != nil {
+					b.Logger().Error("failed to queue revocation", "username", notDeleted.Username, "error", queueErr)
+				}
+				err = notDeleted.Err
+			}
+
+			if releaseErr := b.releaseUser(ctx, req.Storage, roleName, created); releaseErr != nil {
+				b.Logger().Error("failed to release role usage", "role", roleName, "error", releaseErr)
+			}
+			return nil, err
+		}
+
+		username = rawData["username"].(string)
+		if role.ProviderName != "" {
+			rawData["provider_name"] = role.ProviderName
+			rawData["provider_subject"] = providerSubject
+		}
+
+		err = saveUserEntry(ctx, req.Storage, &userEntry{
+			Username:   username,
+			Role:       roleName,
+			Region:     role.Region,
+			UserPoolId: role.UserPoolId,
+			EntityID:   req.EntityID,
+			CreateTime: time.Now().UTC(),
+			ExpireTime: expiresAt,
+		})
+		if err != nil {
+			// without its entry the user would not be tracked, so it is deleted,
+			// or queued for revocation if it cannot be deleted
+			created := false
+			if deleteErr := client.deleteUser(ctx, role.Region, role.UserPoolId, username); deleteErr != nil {
+				created = true
+				b.Logger().Error("failed to delete untracked user, queueing for retry", "username", username, "error", deleteErr)
+				revocation := &revocationEntry{
+					Username:   username,
+					Role:       roleName,
+					Region:     role.Region,
+					UserPoolId: role.UserPoolId,
+				}
+				if queueErr := queueRevocation(ctx, req.Storage, revocation, deleteErr, time.Now()); queueErr != nil {
+					b.Logger().Error("failed to queue revocation", "username", username, "error", queueErr)
+				}
+			}
+
+			if releaseErr := b.releaseUser(ctx, req.Storage, roleName, created); releaseErr != nil {
+				b.Logger().Error("failed to release role usage", "role", roleName, "error", releaseErr)
+			}
+			return nil, errwrap.Wrapf("error storing user: {{err}}", err)
+		}
+
+		// the user pool is recorded in the lease, so that the user can be revoked
+		// if the role is changed or deleted
 		internalData := map[string]interface{}{
-			"username": rawData["username"],
-			"role":     roleName,
+			"username":     username,
+			"role":         roleName,
+			"region":       role.Region,
+			"user_pool_id": role.UserPoolId,
+		}
+		// the ttl requested on creds is recorded so that renewals keep it
+		if userReq.TTL > 0 {
+			internalData["ttl"] = int64(userReq.TTL / time.Second)
 		}
 		resp := b.Secret(SecretTypeUser).Response(rawData, internalData)
-		resp.Secret.TTL = role.TTL
+		resp.Secret.TTL = ttl
 		resp.Secret.MaxTTL = role.MaxTTL
 
 		return resp, nil
-	} else {
-		rawData, err := client.getClientCredentialsGrant(role.CognitoPoolDomain, role.AppClientId, role.AppClientSecret)
+	} else if role.CredentialType == credentialTypeClientCredentialsGrant {
+		// concurrent requests for the same app client get the same token, so they are
+		// merged into one request to the token endpoint
+		key := tokenRequestKey(role.CognitoPoolDomain, role.AppClientId, role.AppClientSecret)
+		rawData, shared, err := b.tokens.do(ctx, key, func(ctx context.Context) (map[string]interface{}, error) {
+			release, err := b.acquireCredsSlots(ctx, req.Storage, roleName, fmt.Sprintf("token endpoint '%s'", role.CognitoPoolDomain))
+			if err != nil {
+				return nil, err
+			}
+			defer release()
+
+			return client.getClientCredentialsGrant(ctx, role.CognitoPoolDomain, role.AppClientId, role.AppClientSecret)
+		})
+		if shared {
+			recordTokenCoalesced(roleName, role.CredentialType)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -83,6 +332,9 @@ func (b *cognitoSecretBackend) pathCredsRead(ctx context.Context, req *logical.R
 		}
 		return resp, nil
 	}
+
+	// roles stored before credential_type was validated may hold any value
+	return logical.ErrorResponse(fmt.Sprintf("role '%s' has unsupported credential_type '%s'", roleName, role.CredentialType)), nil
 }
 
 func (b *cognitoSecretBackend) userRenew(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
@@ -102,13 +354,182 @@ func (b *cognitoSecretBackend) userRenew(ctx context.Context, req *logical.Reque
 
 	resp := &logical.Response{Secret: req.Secret}
 	if role.CredentialType == credentialTypeUser {
-		resp.Secret.TTL = role.TTL
+		ttl, err := leaseTTL(req.Secret, role)
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Secret.TTL = ttl
 		resp.Secret.MaxTTL = role.MaxTTL
+
+		usernameRaw, ok := req.Secret.InternalData["username"]
+		if !ok {
+			return nil, errors.New("internal data 'username' not found")
+		}
+
+		region, userPoolId, err := leaseUserPool(ctx, req.Storage, req.Secret.InternalData, roleRaw.(string))
+		if err != nil {
+			return nil, err
+		}
+
+		expiresAt := b.leaseExpiry(role, ttl, req.Secret.IssueTime)
+		user, err := getUserEntry(ctx, req.Storage, userKey(region, userPoolId, usernameRaw.(string)))
+		if err != nil {
+			return nil, errwrap.Wrapf("error reading user entry: {{err}}", err)
+		}
+
+		if user != nil {
+			user.ExpireTime = expiresAt
+			if err := saveUserEntry(ctx, req.Storage, user); err != nil {
+				return nil, errwrap.Wrapf("error storing user: {{err}}", err)
+			}
+		}
+
+		if attribute, ok := role.MetadataAttributes[metadataExpiresAt]; ok {
+			client, err := b.getClient(ctx, req)
+			if err != nil {
+				return nil, err
+			}
+
+			err = client.updateUserAttributes(ctx, region, userPoolId, usernameRaw.(string), map[string]string{
+				attribute: expiresAt.Format(time.RFC3339),
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		recordRenew(roleRaw.(string))
 	}
 
 	return resp, nil
 }
 
+// leaseTTL returns the ttl of a user lease, which is the ttl requested on creds
+// if one was, or the ttl of the role.
+func leaseTTL(secret *logical.Secret, role *roleEntry) (time.Duration, error) {
+	ttlRaw, ok := secret.InternalData["ttl"]
+	if !ok {
+		return role.TTL, nil
+	}
+
+	// the internal data is stored as JSON, so the ttl may be read back as a float
+	ttl, err := parseutil.ParseDurationSecond(ttlRaw)
+	if err != nil {
+		return 0, errwrap.Wrapf("invalid internal data 'ttl': {{err}}", err)
+	}
+	return ttl, nil
+}
+
+// userRequest holds the request time parameters for a new user
+type userRequest struct {
+	Groups         []string
+	TTL            time.Duration
+	Attributes     map[string]string
+	UsernameSuffix string
+}
+
+// usernameSuffixRegex matches the characters allowed in a username suffix
+var usernameSuffixRegex = regexp.MustCompile(`^[a-zA-Z0-9._+-]*$`)
+
+// parseUserRequest reads the request time parameters for a new user and checks
+// them against the limits of the role, an error response is returned if the
+// request exceeds them.
+func parseUserRequest(d *framework.FieldData, roleName string, role *roleEntry, systemMaxTTL time.Duration) (*userRequest, *logical.Response) {
+	userReq := &userRequest{
+		Groups:     role.userGroups(),
+		Attributes: map[string]string{},
+	}
+
+	if groupsRaw, ok := d.GetOk("groups"); ok {
+		userReq.Groups = groupsRaw.([]string)
+		allowedGroups := role.requestableGroups()
+		for _, group := range userReq.Groups {
+			if !strutil.StrListContains(allowedGroups, group) {
+				return nil, logical.ErrorResponse(fmt.Sprintf("group '%s' is not allowed by role '%s'", group, roleName))
+			}
+		}
+	}
+
+	if ttlRaw, ok := d.GetOk("ttl"); ok {
+		userReq.TTL = time.Duration(ttlRaw.(int)) * time.Second
+
+		maxTTL := role.MaxTTL
+		if maxTTL == 0 {
+			maxTTL = systemMaxTTL
+		}
+		if userReq.TTL < 0 || (maxTTL > 0 && userReq.TTL > maxTTL) {
+			return nil, logical.ErrorResponse(fmt.Sprintf("ttl must be between 0 and %d seconds for role '%s'", maxTTL/time.Second, roleName))
+		}
+	}
+
+	if attributesRaw, ok := d.GetOk("attributes"); ok {
+		userReq.Attributes = attributesRaw.(map[string]string)
+		for name := range userReq.Attributes {
+			if !strutil.StrListContainsGlob(role.AllowedAttributes, name) {
+				return nil, logical.ErrorResponse(fmt.Sprintf("attribute '%s' is not allowed by role '%s'", name, roleName))
+			}
+
+			for _, metadataAttribute := range role.MetadataAttributes {
+				if name == metadataAttribute {
+					return nil, logical.ErrorResponse(fmt.Sprintf("attribute '%s' is reserved for lease metadata", name))
+				}
+			}
+		}
+	}
+
+	if suffixRaw, ok := d.GetOk("username_suffix"); ok {
+		userReq.UsernameSuffix = suffixRaw.(string)
+		if len(userReq.UsernameSuffix) > role.MaxUsernameSuffixLength {
+			return nil, logical.ErrorResponse(fmt.Sprintf("username_suffix cannot be longer than %d characters for role '%s'", role.MaxUsernameSuffixLength, roleName))
+		}
+
+		if !usernameSuffixRegex.MatchString(userReq.UsernameSuffix) {
+			return nil, logical.ErrorResponse("username_suffix can only contain letters, numbers and the characters . _ + -")
+		}
+	}
+
+	return userReq, nil
+}
+
+// leaseExpiry estimates when a lease with the ttl, issued at issueTime for the role,
+// will expire if renewed now, based on the role and mount TTLs.
+func (b *cognitoSecretBackend) leaseExpiry(role *roleEntry, ttl time.Duration, issueTime time.Time) time.Time {
+	if ttl == 0 {
+		ttl = b.System().DefaultLeaseTTL()
+	}
+
+	maxTTL := b.System().MaxLeaseTTL()
+	if role.MaxTTL > 0 && (maxTTL == 0 || role.MaxTTL < maxTTL) {
+		maxTTL = role.MaxTTL
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	if maxTTL > 0 && !issueTime.IsZero() && expiresAt.After(issueTime.Add(maxTTL)) {
+		expiresAt = issueTime.Add(maxTTL)
+	}
+	return expiresAt.UTC().Truncate(time.Second)
+}
+
+// metadataAttributes returns the user attributes that record the lease metadata
+// configured in the role's metadata attributes.
+func metadataAttributes(req *logical.Request, roleName string, role *roleEntry, expiresAt time.Time) map[string]string {
+	attributes := make(map[string]string, len(role.MetadataAttributes))
+	for key, attribute := range role.MetadataAttributes {
+		switch key {
+		case metadataRole:
+			attributes[attribute] = roleName
+		case metadataEntity:
+			attributes[attribute] = req.EntityID
+		case metadataMount:
+			attributes[attribute] = req.MountPoint
+		case metadataExpiresAt:
+			attributes[attribute] = expiresAt.Format(time.RFC3339)
+		}
+	}
+	return attributes
+}
+
 func (b *cognitoSecretBackend) userRevoke(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	resp := new(logical.Response)
 	roleRaw, ok := req.Secret.InternalData["role"]
@@ -116,27 +537,195 @@ func (b *cognitoSecretBackend) userRevoke(ctx context.Context, req *logical.Requ
 		return nil, errors.New("internal data 'role' not found")
 	}
 
-	role, err := getRole(ctx, roleRaw.(string), req.Storage)
+	usernameRaw, ok := req.Secret.InternalData["username"]
+	if !ok {
+		return nil, errors.New("internal data 'username' not found")
+	}
+
+	username := usernameRaw.(string)
+	b.Logger().Info(fmt.Sprintf("Revoking lease for User: %s", username))
+
+	region, userPoolId, err := leaseUserPool(ctx, req.Storage, req.Secret.InternalData, roleRaw.(string))
 	if err != nil {
 		return nil, err
 	}
 
-	client, _ := b.getClient(ctx, req)
-	if role.CredentialType == credentialTypeUser {
-		usernameRaw, ok := req.Secret.InternalData["username"]
-		if !ok {
-			return nil, errors.New("internal data 'username' not found")
+	if userPoolId == "" {
+		// the lease predates the user pool being recorded, and neither its user
+		// entry nor its role remain, so the user cannot be deleted. The revocation
+		// fails rather than leave the user in an unknown user pool.
+		err := fmt.Errorf("unable to find the user pool of user %s as its role %s has been deleted, delete the user by hand and force the revocation of the lease", username, roleRaw.(string))
+		recordRevoke(roleRaw.(string), err)
+		return nil, err
+	}
+
+	user, err := getUserEntry(ctx, req.Storage, userKey(region, userPoolId, username))
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading user entry: {{err}}", err)
+	}
+
+	// The user is no longer tracked once revocation has been attempted, if the
+	// delete fails it is queued and retried in the background, see
+	// queueRevocation. Until the retry succeeds tidy may also delete the user,
+	// which the retry then treats as deleted.
+	if user != nil {
+		if err := deleteUserEntry(ctx, req.Storage, user.key()); err != nil {
+			return nil, errwrap.Wrapf("error deleting user entry: {{err}}", err)
+		}
+
+		if err := b.releaseUser(ctx, req.Storage, user.Role, true); err != nil {
+			return nil, err
+		}
+	}
+
+	client, err := b.getClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.deleteUser(ctx, region, userPoolId, username)
+	recordRevoke(roleRaw.(string), err)
+	if err != nil {
+		// the deletion is retried in the background rather than failing the
+		// revocation, so that the lease is not stuck while Cognito is unavailable
+		b.Logger().Error(fmt.Sprintf("Failed to revoke lease for User: %s, queueing for retry", username), "error", err)
+		err = queueRevocation(ctx, req.Storage, &revocationEntry{
+			Username:   username,
+			Role:       roleRaw.(string),
+			Region:     region,
+			UserPoolId: userPoolId,
+		}, err, time.Now())
+		if err != nil {
+			return nil, errwrap.Wrapf("error storing revocation: {{err}}", err)
+		}
+	}
+	return resp, nil
+}
+
+// leaseUserPool returns the user pool of a leased user, from the lease if it
+// was recorded there, otherwise from the role's user entry or the role.
+func leaseUserPool(ctx context.Context, s logical.Storage, internalData map[string]interface{}, roleName string) (string, string, error) {
+	if userPoolId, ok := internalData["user_pool_id"].(string); ok && userPoolId != "" {
+		region, _ := internalData["region"].(string)
+		return region, userPoolId, nil
+	}
+
+	username, _ := internalData["username"].(string)
+	user, err := findRoleUserEntry(ctx, s, roleName, username)
+	if err != nil {
+		return "", "", err
+	}
+
+	if user != nil {
+		return user.Region, user.UserPoolId, nil
+	}
+
+	role, err := getRole(ctx, roleName, s)
+	if err != nil {
+		return "", "", err
+	}
+
+	if role == nil {
+		return "", "", nil
+	}
+
+	return role.Region, role.UserPoolId, nil
+}
+
+// findRoleUserEntry returns the role's user entry with the username, for leases
+// that do not record the user pool. No entry is returned if users in more than
+// one user pool have the username, as the user pool cannot be known.
+func findRoleUserEntry(ctx context.Context, s logical.Storage, roleName string, username string) (*userEntry, error) {
+	users, err := roleUserEntries(ctx, s, roleName)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *userEntry
+	for _, user := range users {
+		if user.Username != username {
+			continue
+		}
+		if found != nil {
+			return nil, nil
 		}
+		found = user
+	}
+
+	return found, nil
+}
 
-		username := usernameRaw.(string)
-		b.Logger().Info(fmt.Sprintf("Revoking lease for User: %s", username))
+// userKey returns the key that a user is stored under, relative to the users
+// and revocations storage paths. Users are keyed by their user pool, as roles
+// on different user pools may create users with the same username.
+func userKey(region string, userPoolId string, username string) string {
+	return fmt.Sprintf("%s/%s/%s", region, userPoolId, username)
+}
 
-		err = client.deleteUser(role.Region, role.UserPoolId, username)
+func (u *userEntry) key() string {
+	return userKey(u.Region, u.UserPoolId, u.Username)
+}
+
+func saveUserEntry(ctx context.Context, s logical.Storage, u *userEntry) error {
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", usersStoragePath, u.key()), u)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func getUserEntry(ctx context.Context, s logical.Storage, key string) (*userEntry, error) {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", usersStoragePath, key))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	u := new(userEntry)
+	if err := entry.DecodeJSON(u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+func deleteUserEntry(ctx context.Context, s logical.Storage, key string) error {
+	return s.Delete(ctx, fmt.Sprintf("%s/%s", usersStoragePath, key))
+}
+
+// listUserEntries returns the keys of the users with an active lease, see userKey
+func listUserEntries(ctx context.Context, s logical.Storage) ([]string, error) {
+	keys, err := logical.CollectKeys(ctx, logical.NewStorageView(s, usersStoragePath+"/"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// roleUserEntries returns the users with an active lease that were created for the role
+func roleUserEntries(ctx context.Context, s logical.Storage, roleName string) ([]*userEntry, error) {
+	keys, err := listUserEntries(ctx, s)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing users: {{err}}", err)
+	}
+
+	var users []*userEntry
+	for _, key := range keys {
+		user, err := getUserEntry(ctx, s, key)
 		if err != nil {
-			b.Logger().Error(fmt.Sprintf("Failed to revoke lease for User: %s", username), err)
+			return nil, errwrap.Wrapf("error reading user entry: {{err}}", err)
+		}
+
+		if user != nil && user.Role == roleName {
+			users = append(users, user)
 		}
 	}
-	return resp, err
+
+	return users, nil
 }
 
 const pathCredsHelpSyn = `
@@ -148,6 +737,9 @@ This path creates credentials for the configured user pool.
 The associated role can be configured to create either a user or
 request an client credentials grant access token,
 The user will be automatically deleted when the lease has expired.
+Writing to this path for a user role allows the groups, lease,
+attributes and username suffix of the user to be chosen, within
+the limits allowed by the role.
 The client credentials grant access token will only be valid for
 the time configured in the app client. 
 `
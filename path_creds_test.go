@@ -2,7 +2,9 @@ package cognito
 
 import (
 	"context"
+	"errors"
 	"github.com/hashicorp/vault/sdk/logical"
+	"strings"
 	"testing"
 	"time"
 )
@@ -48,6 +50,10 @@ func TestUserRead(t *testing.T) {
 		name := generateUUID()
 		testRole := map[string]interface{}{
 			"credential_type": "user",
+			"region":          "eu-west-1",
+			"user_pool_id":    "eu-west-1_aaaa",
+			"group":           "testGroup",
+			"app_client_id":   "testAppClientId",
 		}
 		testRoleCreate(t, b, s, name, testRole)
 
@@ -75,6 +81,10 @@ func TestUserRead(t *testing.T) {
 		name := generateUUID()
 		testRole := map[string]interface{}{
 			"credential_type": "user",
+			"region":          "eu-west-1",
+			"user_pool_id":    "eu-west-1_aaaa",
+			"group":           "testGroup",
+			"app_client_id":   "testAppClientId",
 		}
 		testRoleCreate(t, b, s, name, testRole)
 
@@ -107,3 +117,803 @@ func TestUserRead(t *testing.T) {
 		equal(t, 30*time.Second, resp.Secret.MaxTTL)
 	})
 }
+
+func TestUserMetadataAttributes(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	name := generateUUID()
+	testRole := map[string]interface{}{
+		"credential_type": "user",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaa",
+		"group":           "testGroup",
+		"app_client_id":   "testAppClientId",
+		"ttl":             60,
+		"metadata_attributes": map[string]interface{}{
+			"role":       "custom:vault_role",
+			"entity":     "custom:vault_entity",
+			"mount":      "custom:vault_mount",
+			"expires_at": "custom:vault_expires_at",
+		},
+	}
+	testRoleCreate(t, b, s, name, testRole)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation:  logical.ReadOperation,
+		Path:       "creds/" + name,
+		Storage:    s,
+		EntityID:   "test-entity",
+		MountPoint: "cognito/",
+	})
+	assertErrorIsNil(t, err)
+
+	if resp.IsError() {
+		t.Fatalf("expected no response error, actual:%#v", resp.Error())
+	}
+
+	mc := b.client.(*mockClient)
+	attributes := mc.newUserInputs[0].Attributes
+	equal(t, name, attributes["custom:vault_role"])
+	equal(t, "test-entity", attributes["custom:vault_entity"])
+	equal(t, "cognito/", attributes["custom:vault_mount"])
+	expiresAt, err := time.Parse(time.RFC3339, attributes["custom:vault_expires_at"])
+	assertErrorIsNil(t, err)
+	if expiresAt.Before(time.Now()) || expiresAt.After(time.Now().Add(61*time.Second)) {
+		t.Fatalf("expected expiry within the role ttl, actual: %s", expiresAt)
+	}
+
+	// verify renewals update the expiry
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RenewOperation,
+		Secret: &logical.Secret{
+			InternalData: map[string]interface{}{
+				"secret_type": SecretTypeUser,
+				"username":    resp.Data["username"],
+				"role":        name,
+			},
+			LeaseOptions: logical.LeaseOptions{
+				IssueTime: time.Now(),
+			},
+		},
+		Storage: s,
+	})
+	assertErrorIsNil(t, err)
+
+	updated, ok := mc.updatedAttributes[resp.Data["username"].(string)]
+	if !ok {
+		t.Fatal("expected user attributes to be updated on renewal")
+	}
+	if _, err := time.Parse(time.RFC3339, updated["custom:vault_expires_at"]); err != nil {
+		t.Fatalf("expected expiry to be a timestamp, actual: %s", updated["custom:vault_expires_at"])
+	}
+}
+
+func TestUserAttributeTemplates(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	b.System().(*logical.StaticSystemView).EntityVal = &logical.Entity{
+		ID:   "test-entity",
+		Name: "test-entity-name",
+		Metadata: map[string]string{
+			"tenant_id": "tenant-a",
+		},
+		Aliases: []*logical.Alias{
+			{
+				MountAccessor: "auth_userpass_1234",
+				MountType:     "userpass",
+				Name:          "test-user",
+			},
+		},
+	}
+
+	name := generateUUID()
+	testRole := map[string]interface{}{
+		"credential_type": "user",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaa",
+		"group":           "testGroup",
+		"app_client_id":   "testAppClientId",
+		"user_attributes": map[string]interface{}{
+			"custom:tenant_id": `{{index .Entity.Metadata "tenant_id"}}`,
+			"custom:org_role":  `{{.RoleName | uppercase}}`,
+			"custom:requester": `{{(index .Entity.Aliases "auth_userpass_1234").Name}}`,
+			"custom:nonce":     `{{random 10}}`,
+			"locale":           "en-GB",
+		},
+	}
+	testRoleCreate(t, b, s, name, testRole)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + name,
+		Storage:   s,
+		EntityID:  "test-entity",
+	})
+	assertErrorIsNil(t, err)
+
+	if resp.IsError() {
+		t.Fatalf("expected no response error, actual:%#v", resp.Error())
+	}
+
+	attributes := b.client.(*mockClient).newUserInputs[0].Attributes
+	equal(t, "tenant-a", attributes["custom:tenant_id"])
+	equal(t, strings.ToUpper(name), attributes["custom:org_role"])
+	equal(t, "test-user", attributes["custom:requester"])
+	equal(t, 10, len(attributes["custom:nonce"]))
+	equal(t, "en-GB", attributes["locale"])
+}
+
+func TestUserClientMetadata(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	name := generateUUID()
+	testRoleCreate(t, b, s, name, map[string]interface{}{
+		"credential_type": "user",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaa",
+		"group":           "testGroup",
+		"app_client_id":   "testAppClientId",
+		"ttl":             300,
+		"client_metadata": map[string]interface{}{
+			"vault_role":       `{{.RoleName}}`,
+			"vault_ttl":        `{{.TTL}}`,
+			"vault_expires_at": `{{.ExpiresAt}}`,
+			"test_user":        "true",
+		},
+	})
+
+	issued := time.Now()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/" + name,
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+
+	if resp.IsError() {
+		t.Fatalf("expected no response error, actual:%#v", resp.Error())
+	}
+
+	metadata := b.client.(*mockClient).newUserInputs[0].ClientMetadata
+	equal(t, name, metadata["vault_role"])
+	equal(t, "300", metadata["vault_ttl"])
+	equal(t, "true", metadata["test_user"])
+
+	expiresAt, err := time.Parse(time.RFC3339, metadata["vault_expires_at"])
+	assertErrorIsNil(t, err)
+	if expiresAt.Sub(issued.Add(300*time.Second)).Round(time.Minute) != 0 {
+		t.Fatalf("unexpected expiry %s", expiresAt)
+	}
+}
+
+func TestUserProviderLink(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	t.Run("Not linked by default", func(t *testing.T) {
+		name := generateUUID()
+		testRoleCreate(t, b, s, name, map[string]interface{}{
+			"credential_type": "user",
+			"region":          "eu-west-1",
+			"user_pool_id":    "eu-west-1_aaaa",
+			"group":           "testGroup",
+			"app_client_id":   "testAppClientId",
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + name,
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+
+		if resp.IsError() {
+			t.Fatalf("expected no response error, actual:%#v", resp.Error())
+		}
+
+		inputs := b.client.(*mockClient).newUserInputs
+		equal(t, "", inputs[len(inputs)-1].ProviderName)
+		if _, ok := resp.Data["provider_subject"]; ok {
+			t.Fatal("expected no provider_subject")
+		}
+	})
+
+	t.Run("Linked to provider", func(t *testing.T) {
+		name := generateUUID()
+		testRoleCreate(t, b, s, name, map[string]interface{}{
+			"credential_type":           "user",
+			"region":                    "eu-west-1",
+			"user_pool_id":              "eu-west-1_aaaa",
+			"group":                     "testGroup",
+			"app_client_id":             "testAppClientId",
+			"dummy_email_domain":        "example.com",
+			"provider_name":             "CorporateSAML",
+			"provider_subject_template": `{{.RoleName}}-{{.Email}}`,
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + name,
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+
+		if resp.IsError() {
+			t.Fatalf("expected no response error, actual:%#v", resp.Error())
+		}
+
+		inputs := b.client.(*mockClient).newUserInputs
+		input := inputs[len(inputs)-1]
+		equal(t, "CorporateSAML", input.ProviderName)
+		equal(t, defaultProviderAttributeName, input.ProviderAttributeName)
+		equal(t, name+"-"+input.Attributes["email"], input.ProviderSubject)
+		equal(t, "CorporateSAML", resp.Data["provider_name"])
+		equal(t, input.ProviderSubject, resp.Data["provider_subject"])
+	})
+
+	t.Run("Role stored without provider attribute name", func(t *testing.T) {
+		name := generateUUID()
+		// roles stored before users could be linked have no provider fields
+		err := saveRole(context.Background(), s, &roleEntry{
+			CredentialType: credentialTypeUser,
+			Region:         "eu-west-1",
+			UserPoolId:     "eu-west-1_aaaa",
+			AppClientId:    "testAppClientId",
+			Group:          "testGroup",
+		}, name)
+		assertErrorIsNil(t, err)
+
+		testRoleCreate(t, b, s, name, map[string]interface{}{
+			"provider_name": "CorporateSAML",
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + name,
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+
+		if resp.IsError() {
+			t.Fatalf("expected no response error, actual:%#v", resp.Error())
+		}
+
+		inputs := b.client.(*mockClient).newUserInputs
+		input := inputs[len(inputs)-1]
+		equal(t, "CorporateSAML", input.ProviderName)
+		equal(t, defaultProviderAttributeName, input.ProviderAttributeName)
+		// the role has no dummy email domain, so the email is only used in templates
+		equal(t, input.Username, input.ProviderSubject)
+		if _, ok := input.Attributes["email"]; ok {
+			t.Fatal("expected no email")
+		}
+	})
+}
+
+func TestUsernameTemplates(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	t.Run("Default templates", func(t *testing.T) {
+		name := generateUUID()
+		testRoleCreate(t, b, s, name, map[string]interface{}{
+			"credential_type":    "user",
+			"region":             "eu-west-1",
+			"user_pool_id":       "eu-west-1_aaaa",
+			"group":              "testGroup",
+			"app_client_id":      "testAppClientId",
+			"dummy_email_domain": "example.com",
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + name,
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+
+		if resp.IsError() {
+			t.Fatalf("expected no response error, actual:%#v", resp.Error())
+		}
+
+		mc := b.client.(*mockClient)
+		input := mc.newUserInputs[len(mc.newUserInputs)-1]
+		if !strings.HasPrefix(input.Attributes["email"], "vault") || !strings.HasSuffix(input.Attributes["email"], "@example.com") || len(input.Attributes["email"]) != 48 {
+			t.Fatalf("unexpected default email: %s", input.Attributes["email"])
+		}
+		equal(t, input.Attributes["email"], input.Username)
+	})
+
+	t.Run("Custom templates", func(t *testing.T) {
+		name := generateUUID()
+		testRoleCreate(t, b, s, name, map[string]interface{}{
+			"credential_type":    "user",
+			"region":             "eu-west-1",
+			"user_pool_id":       "eu-west-1_aaaa",
+			"group":              "testGroup",
+			"app_client_id":      "testAppClientId",
+			"dummy_email_domain": "example.com",
+			"username_template":  `vault-{{.DisplayName}}-{{index .Entity.Metadata "ci_job_id"}}`,
+			"email_template":     `{{.DisplayName}}+{{random 6}}@{{.DummyEmailDomain}}`,
+		})
+
+		b.System().(*logical.StaticSystemView).EntityVal = &logical.Entity{
+			ID: "test-entity",
+			Metadata: map[string]string{
+				"ci_job_id": "1234",
+			},
+		}
+		defer func() { b.System().(*logical.StaticSystemView).EntityVal = nil }()
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation:   logical.ReadOperation,
+			Path:        "creds/" + name,
+			Storage:     s,
+			DisplayName: "token-ci",
+			EntityID:    "test-entity",
+		})
+		assertErrorIsNil(t, err)
+
+		if resp.IsError() {
+			t.Fatalf("expected no response error, actual:%#v", resp.Error())
+		}
+
+		mc := b.client.(*mockClient)
+		input := mc.newUserInputs[len(mc.newUserInputs)-1]
+		equal(t, "vault-token-ci-1234", input.Username)
+		if !strings.HasPrefix(input.Attributes["email"], "token-ci+") || !strings.HasSuffix(input.Attributes["email"], "@example.com") {
+			t.Fatalf("unexpected email: %s", input.Attributes["email"])
+		}
+	})
+}
+
+func TestUserPasswordPolicy(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	b.System().(*logical.StaticSystemView).PasswordPolicies = map[string]logical.PasswordGenerator{
+		"cognito": func() (string, error) { return "Vault-Password-1", nil },
+		"weak":    func() (string, error) { return "password", nil },
+	}
+
+	t.Run("Policy password", func(t *testing.T) {
+		name := generateUUID()
+		testRoleCreate(t, b, s, name, map[string]interface{}{
+			"credential_type": "user",
+			"region":          "eu-west-1",
+			"user_pool_id":    "eu-west-1_aaaa",
+			"group":           "testGroup",
+			"app_client_id":   "testAppClientId",
+			"password_policy": "cognito",
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + name,
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+
+		if resp.IsError() {
+			t.Fatalf("expected no response error, actual:%#v", resp.Error())
+		}
+
+		mc := b.client.(*mockClient)
+		equal(t, "Vault-Password-1", mc.newUserInputs[len(mc.newUserInputs)-1].Password)
+	})
+
+	t.Run("Policy password rejected by user pool", func(t *testing.T) {
+		name := generateUUID()
+		testRoleCreate(t, b, s, name, map[string]interface{}{
+			"credential_type": "user",
+			"region":          "eu-west-1",
+			"user_pool_id":    "eu-west-1_aaaa",
+			"group":           "testGroup",
+			"app_client_id":   "testAppClientId",
+			"password_policy": "weak",
+		})
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + name,
+			Storage:   s,
+		})
+		if err == nil {
+			t.Fatal("expected an error for a password that does not satisfy the user pool policy")
+		}
+	})
+}
+
+func TestUserGroups(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	name := generateUUID()
+	testRoleCreate(t, b, s, name, map[string]interface{}{
+		"credential_type": "user",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaa",
+		"app_client_id":   "testAppClientId",
+		"group":           "tenant-a",
+		"groups":          "approver,tenant-a",
+		"allowed_groups":  "tenant-a,tenant-b,approver",
+	})
+
+	tests := map[string]struct {
+		op       logical.Operation
+		groups   interface{}
+		exp      []string
+		expError bool
+	}{
+		"role groups":         {logical.ReadOperation, nil, []string{"tenant-a", "approver"}, false},
+		"requested groups":    {logical.UpdateOperation, "tenant-b,approver", []string{"tenant-b", "approver"}, false},
+		"group not allowed":   {logical.UpdateOperation, "tenant-a,admin", nil, true},
+		"no groups requested": {logical.UpdateOperation, nil, []string{"tenant-a", "approver"}, false},
+	}
+
+	for desc, test := range tests {
+		t.Run(desc, func(t *testing.T) {
+			data := map[string]interface{}{}
+			if test.groups != nil {
+				data["groups"] = test.groups
+			}
+
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: test.op,
+				Path:      "creds/" + name,
+				Data:      data,
+				Storage:   s,
+			})
+			assertErrorIsNil(t, err)
+
+			if resp.IsError() != test.expError {
+				t.Fatalf("exp error: %t\ngot: %v", test.expError, resp.Error())
+			}
+
+			if !test.expError {
+				mc := b.client.(*mockClient)
+				equal(t, test.exp, mc.newUserInputs[len(mc.newUserInputs)-1].Groups)
+			}
+		})
+	}
+}
+
+func TestUserRequestParameters(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	name := generateUUID()
+	testRoleCreate(t, b, s, name, map[string]interface{}{
+		"credential_type":            "user",
+		"region":                     "eu-west-1",
+		"user_pool_id":               "eu-west-1_aaaa",
+		"group":                      "testGroup",
+		"app_client_id":              "testAppClientId",
+		"dummy_email_domain":         "example.com",
+		"email_template":             "vault-test@{{.DummyEmailDomain}}",
+		"allowed_attributes":         "custom:plan,custom:feature_*",
+		"max_username_suffix_length": 8,
+		"ttl":                        60,
+		"max_ttl":                    600,
+		"metadata_attributes": map[string]interface{}{
+			"role": "custom:feature_role",
+		},
+	})
+
+	tests := map[string]struct {
+		data     map[string]interface{}
+		expError bool
+	}{
+		"ttl":                      {map[string]interface{}{"ttl": 300}, false},
+		"ttl greater than max_ttl": {map[string]interface{}{"ttl": 601}, true},
+		"allowed attribute":        {map[string]interface{}{"attributes": "custom:plan=premium"}, false},
+		"allowed attribute glob":   {map[string]interface{}{"attributes": "custom:feature_x=on"}, false},
+		"attribute not allowed":    {map[string]interface{}{"attributes": "custom:tenant_id=other"}, true},
+		"metadata attribute":       {map[string]interface{}{"attributes": "custom:feature_role=other"}, true},
+		"username suffix":          {map[string]interface{}{"username_suffix": "-job123"}, false},
+		"username suffix too long": {map[string]interface{}{"username_suffix": "-job123456"}, true},
+		"username suffix invalid":  {map[string]interface{}{"username_suffix": "job@1"}, true},
+	}
+
+	for desc, test := range tests {
+		t.Run(desc, func(t *testing.T) {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.UpdateOperation,
+				Path:      "creds/" + name,
+				Data:      test.data,
+				Storage:   s,
+			})
+			assertErrorIsNil(t, err)
+
+			if resp.IsError() != test.expError {
+				t.Fatalf("exp error: %t\ngot: %v", test.expError, resp.Error())
+			}
+		})
+	}
+
+	t.Run("Values are applied", func(t *testing.T) {
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/" + name,
+			Data: map[string]interface{}{
+				"ttl":             300,
+				"attributes":      "custom:plan=premium",
+				"username_suffix": "-job123",
+			},
+			Storage: s,
+		})
+		assertErrorIsNil(t, err)
+
+		if resp.IsError() {
+			t.Fatalf("expected no response error, actual:%#v", resp.Error())
+		}
+
+		equal(t, 300*time.Second, resp.Secret.TTL)
+
+		mc := b.client.(*mockClient)
+		input := mc.newUserInputs[len(mc.newUserInputs)-1]
+		equal(t, "premium", input.Attributes["custom:plan"])
+		equal(t, "vault-test-job123@example.com", input.Username)
+		equal(t, "vault-test-job123@example.com", input.Attributes["email"])
+	})
+
+	t.Run("Requested ttl is kept on renewal", func(t *testing.T) {
+		name := generateUUID()
+		testRoleCreate(t, b, s, name, map[string]interface{}{
+			"credential_type": "user",
+			"region":          "eu-west-1",
+			"user_pool_id":    "eu-west-1_aaaa",
+			"group":           "testGroup",
+			"app_client_id":   "testAppClientId",
+			"ttl":             60,
+			"max_ttl":         600,
+			"metadata_attributes": map[string]interface{}{
+				"expires_at": "custom:vault_expires_at",
+			},
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "creds/" + name,
+			Data: map[string]interface{}{
+				"ttl": 300,
+			},
+			Storage: s,
+		})
+		assertErrorIsNil(t, err)
+
+		if resp.IsError() {
+			t.Fatalf("expected no response error, actual:%#v", resp.Error())
+		}
+		username := resp.Data["username"].(string)
+
+		// Vault stores the internal data as JSON, so numbers are read back as floats
+		internalData := map[string]interface{}{}
+		for k, v := range resp.Secret.InternalData {
+			internalData[k] = v
+		}
+		internalData["ttl"] = float64(300)
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RenewOperation,
+			Secret: &logical.Secret{
+				InternalData: internalData,
+				LeaseOptions: logical.LeaseOptions{
+					IssueTime: time.Now(),
+				},
+			},
+			Storage: s,
+		})
+		assertErrorIsNil(t, err)
+
+		equal(t, 300*time.Second, resp.Secret.TTL)
+
+		entry, err := getUserEntry(context.Background(), s, userKey("eu-west-1", "eu-west-1_aaaa", username))
+		assertErrorIsNil(t, err)
+		if entry.ExpireTime.Before(time.Now().Add(290 * time.Second)) {
+			t.Fatalf("expected the user to expire after the requested ttl, actual: %s", entry.ExpireTime)
+		}
+
+		mc := b.client.(*mockClient)
+		expiresAt, err := time.Parse(time.RFC3339, mc.updatedAttributes[username]["custom:vault_expires_at"])
+		assertErrorIsNil(t, err)
+		if expiresAt.Before(time.Now().Add(290 * time.Second)) {
+			t.Fatalf("expected the expiry attribute to use the requested ttl, actual: %s", expiresAt)
+		}
+	})
+}
+
+func TestUserProvisioningState(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	for _, state := range provisioningStates {
+		t.Run(state, func(t *testing.T) {
+			name := generateUUID()
+			testRoleCreate(t, b, s, name, map[string]interface{}{
+				"credential_type":    "user",
+				"region":             "eu-west-1",
+				"user_pool_id":       "eu-west-1_aaaa",
+				"group":              "testGroup",
+				"app_client_id":      "testAppClientId",
+				"app_client_secret":  "secret",
+				"provisioning_state": state,
+				"send_invitation":    true,
+			})
+
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "creds/" + name,
+				Storage:   s,
+			})
+			assertErrorIsNil(t, err)
+
+			if resp.IsError() {
+				t.Fatalf("expected no response error, actual:%#v", resp.Error())
+			}
+
+			mc := b.client.(*mockClient)
+			input := mc.newUserInputs[len(mc.newUserInputs)-1]
+			equal(t, state, input.ProvisioningState)
+			equal(t, true, input.SendInvitation)
+			equal(t, "secret", input.AppClientSecret)
+		})
+	}
+}
+
+func TestUserPoolUsernameAttributes(t *testing.T) {
+	b, s := getTestBackend(t, true)
+	mc := b.client.(*mockClient)
+
+	name := generateUUID()
+	testRoleCreate(t, b, s, name, map[string]interface{}{
+		"credential_type":    "user",
+		"region":             "eu-west-1",
+		"user_pool_id":       "eu-west-1_aaaa",
+		"group":              "testGroup",
+		"app_client_id":      "testAppClientId",
+		"dummy_email_domain": "example.com",
+		"username_template":  "vault-{{.RoleName}}",
+	})
+
+	// the role uses the default templates, with no dummy email domain
+	phoneRole := generateUUID()
+	testRoleCreate(t, b, s, phoneRole, map[string]interface{}{
+		"credential_type": "user",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaa",
+		"group":           "testGroup",
+		"app_client_id":   "testAppClientId",
+	})
+
+	tests := map[string]struct {
+		userPool *userPoolDetails
+		role     string
+		check    func(t *testing.T, input *newUserInput)
+		expError bool
+	}{
+		"phone number username": {
+			userPool: &userPoolDetails{UsernameAttributes: []string{"phone_number"}},
+			check: func(t *testing.T, input *newUserInput) {
+				if !strings.HasPrefix(input.Username, "+447700900") || len(input.Username) != 13 {
+					t.Fatalf("expected a phone number username, actual: %s", input.Username)
+				}
+				equal(t, input.Username, input.Attributes["phone_number"])
+				equal(t, "true", input.Attributes["phone_number_verified"])
+				equal(t, "true", input.Attributes["email_verified"])
+			},
+		},
+		"email username": {
+			userPool: &userPoolDetails{UsernameAttributes: []string{"email", "phone_number"}},
+			check: func(t *testing.T, input *newUserInput) {
+				equal(t, input.Attributes["email"], input.Username)
+				if input.Attributes["phone_number"] == "" {
+					t.Fatal("expected a phone number")
+				}
+			},
+		},
+		"preferred username alias": {
+			userPool: &userPoolDetails{AliasAttributes: []string{"preferred_username"}},
+			check: func(t *testing.T, input *newUserInput) {
+				equal(t, "vault-"+name, input.Username)
+				equal(t, "vault-"+name, input.Attributes["preferred_username"])
+				if _, ok := input.Attributes["phone_number"]; ok {
+					t.Fatal("expected no phone number")
+				}
+			},
+		},
+		"phone number username without dummy email domain": {
+			userPool: &userPoolDetails{UsernameAttributes: []string{"phone_number"}},
+			role:     phoneRole,
+			check: func(t *testing.T, input *newUserInput) {
+				equal(t, input.Username, input.Attributes["phone_number"])
+				for _, name := range []string{"email", "email_verified"} {
+					if _, ok := input.Attributes[name]; ok {
+						t.Fatalf("expected no %s, actual: %s", name, input.Attributes[name])
+					}
+				}
+			},
+		},
+		"required attributes not set": {
+			userPool: &userPoolDetails{RequiredAttributes: []string{"email", "given_name"}},
+			expError: true,
+		},
+	}
+
+	for desc, test := range tests {
+		t.Run(desc, func(t *testing.T) {
+			mc.userPool = test.userPool
+			role := name
+			if test.role != "" {
+				role = test.role
+			}
+
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "creds/" + role,
+				Storage:   s,
+			})
+			assertErrorIsNil(t, err)
+
+			if resp.IsError() != test.expError {
+				t.Fatalf("exp error: %t\ngot: %v", test.expError, resp.Error())
+			}
+
+			if test.check != nil {
+				test.check(t, mc.newUserInputs[len(mc.newUserInputs)-1])
+			}
+		})
+	}
+}
+
+func TestUserEntryNotStored(t *testing.T) {
+	setup := func(t *testing.T) (*cognitoSecretBackend, logical.Storage, *mockClient) {
+		b, s := getTestBackend(t, true)
+		testRoleCreate(t, b, s, "test_role", map[string]interface{}{
+			"credential_type":  "user",
+			"region":           "eu-west-1",
+			"user_pool_id":     "eu-west-1_aaaa",
+			"group":            "testGroup",
+			"app_client_id":    "testAppClientId",
+			"max_active_users": 1,
+		})
+		return b, s, b.client.(*mockClient)
+	}
+
+	creds := func(t *testing.T, b *cognitoSecretBackend, s logical.Storage) {
+		t.Helper()
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/test_role",
+			Storage:   &failingStorage{Storage: s, prefix: usersStoragePath + "/"},
+		})
+		if err == nil || !strings.Contains(err.Error(), "error storing user") {
+			t.Fatalf("expected a storage error, actual: %v", err)
+		}
+
+		// the reservation is released
+		usage, err := getRoleUsage(context.Background(), s, "test_role", time.Now())
+		assertErrorIsNil(t, err)
+		equal(t, 0, usage.ActiveUsers)
+	}
+
+	t.Run("The user is deleted", func(t *testing.T) {
+		b, s, mc := setup(t)
+
+		creds(t, b, s)
+		equal(t, []string{"AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"}, mc.deletedUsers)
+
+		keys, err := listRevocationEntries(context.Background(), s)
+		assertErrorIsNil(t, err)
+		equal(t, 0, len(keys))
+	})
+
+	t.Run("The user is queued for revocation", func(t *testing.T) {
+		b, s, mc := setup(t)
+		mc.deleteUserErr = errors.New("TooManyRequestsException: Rate exceeded")
+
+		creds(t, b, s)
+
+		entry, err := getRevocationEntry(context.Background(), s, userKey("eu-west-1", "eu-west-1_aaaa", "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA"))
+		assertErrorIsNil(t, err)
+		if entry == nil {
+			t.Fatal("expected the user to be queued for revocation")
+		}
+		equal(t, "test_role", entry.Role)
+		equal(t, "TooManyRequestsException: Rate exceeded", entry.LastError)
+	})
+}
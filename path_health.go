@@ -0,0 +1,484 @@
+package cognito
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/jsonutil"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	checkOK = "ok"
+
+	checkCredentials            = "credentials"
+	checkDescribeUserPool       = "describe_user_pool"
+	checkDescribeUserPoolClient = "describe_user_pool_client"
+	checkTokenEndpoint          = "token_endpoint"
+)
+
+// adminAuthFlows are the app client auth flows that allow created users to be
+// signed in with their password, see getNewUser
+var adminAuthFlows = []string{
+	"ADMIN_NO_SRP_AUTH",
+	"ALLOW_ADMIN_USER_PASSWORD_AUTH",
+}
+
+func pathsHealth(b *cognitoSecretBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "health",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathHealthRead,
+			},
+			HelpSynopsis:    pathHealthHelpSyn,
+			HelpDescription: pathHealthHelpDesc,
+		},
+		{
+			Pattern: "roles/" + framework.GenericNameRegex("name") + "/check",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the role.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathRoleCheckRead,
+			},
+			HelpSynopsis:    pathRoleCheckHelpSyn,
+			HelpDescription: pathRoleCheckHelpDesc,
+		},
+		{
+			Pattern: "roles/" + framework.GenericNameRegex("name") + "/test",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the role.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.UpdateOperation: b.pathRoleTestWrite,
+			},
+			HelpSynopsis:    pathRoleTestHelpSyn,
+			HelpDescription: pathRoleTestHelpDesc,
+		},
+	}
+}
+
+func (b *cognitoSecretBackend) pathHealthRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	names, err := req.Storage.List(ctx, rolesStoragePath+"/")
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing roles: {{err}}", err)
+	}
+
+	client, err := b.getClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	healthy := true
+	credentials := make(map[string]error)
+	roles := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		role, err := getRole(ctx, name, req.Storage)
+		if err != nil {
+			return nil, errwrap.Wrapf("error reading role: {{err}}", err)
+		}
+
+		if role == nil {
+			continue
+		}
+
+		report := checkRole(ctx, client, role, credentials)
+		healthy = healthy && report["healthy"].(bool)
+		roles[name] = report
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"healthy": healthy,
+			"roles":   roles,
+		},
+	}, nil
+}
+
+func (b *cognitoSecretBackend) pathRoleCheckRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	role, err := getRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading role: {{err}}", err)
+	}
+
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf("role '%s' does not exist", name)), nil
+	}
+
+	client, err := b.getClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	return &logical.Response{
+		Data: checkRole(ctx, client, role, make(map[string]error)),
+	}, nil
+}
+
+// checkRole checks that a role can issue credentials and returns a report of
+// each check, either "ok" or the error of the check. credentials caches the
+// result of the credentials check per region, so that it is made once when
+// checking many roles.
+func checkRole(ctx context.Context, client client, role *roleEntry, credentials map[string]error) map[string]interface{} {
+	checks := make(map[string]error)
+
+	if role.CredentialType == credentialTypeUser {
+		err, ok := credentials[role.Region]
+		if !ok {
+			_, err = client.getCallerIdentity(ctx, role.Region)
+			credentials[role.Region] = err
+		}
+		checks[checkCredentials] = err
+
+		_, checks[checkDescribeUserPool] = client.describeUserPool(ctx, role.Region, role.UserPoolId)
+		if role.usesAppClient() {
+			checks[checkDescribeUserPoolClient] = checkAppClient(ctx, client, role)
+		}
+
+		for action, err := range client.checkActions(ctx, role.Region, role.UserPoolId, role.AppClientId) {
+			checks[action] = err
+		}
+	} else {
+		checks[checkTokenEndpoint] = checkTokenEndpointGrant(ctx, client, role)
+	}
+
+	healthy := true
+	report := make(map[string]interface{}, len(checks))
+	for name, err := range checks {
+		if err != nil {
+			healthy = false
+			report[name] = err.Error()
+			continue
+		}
+		report[name] = checkOK
+	}
+
+	return map[string]interface{}{
+		"healthy":         healthy,
+		"credential_type": role.CredentialType,
+		"checks":          report,
+	}
+}
+
+// checkAppClient checks that the role's app client exists and, if the users
+// are confirmed, allows them to be signed in
+func checkAppClient(ctx context.Context, client client, role *roleEntry) error {
+	if role.AppClientId == "" {
+		return errors.New("the role has no app_client_id")
+	}
+
+	appClient, err := client.describeUserPoolClient(ctx, role.Region, role.UserPoolId, role.AppClientId)
+	if err != nil {
+		return err
+	}
+
+	// unconfirmed users are signed up through the app client, but not signed in
+	if role.provisioningState() != provisioningStateConfirmed {
+		return nil
+	}
+
+	for _, flow := range appClient.ExplicitAuthFlows {
+		if strutil.StrListContains(adminAuthFlows, flow) {
+			return nil
+		}
+	}
+	return fmt.Errorf("app client %s does not allow the ALLOW_ADMIN_USER_PASSWORD_AUTH flow, which signs in created users", role.AppClientId)
+}
+
+// checkTokenEndpointGrant checks that the token endpoint issues a token for
+// the role's app client
+func checkTokenEndpointGrant(ctx context.Context, client client, role *roleEntry) error {
+	rawData, err := client.getClientCredentialsGrant(ctx, role.CognitoPoolDomain, role.AppClientId, role.AppClientSecret)
+	if err != nil {
+		return err
+	}
+
+	if _, ok := rawData["access_token"]; !ok {
+		return fmt.Errorf("the token endpoint did not return a token: %v", rawData["error"])
+	}
+	return nil
+}
+
+func (b *cognitoSecretBackend) pathRoleTestWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	role, err := getRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading role: {{err}}", err)
+	}
+
+	if role == nil {
+		return logical.ErrorResponse(fmt.Sprintf("role '%s' does not exist", name)), nil
+	}
+
+	trace := new(roleTrace)
+	if role.CredentialType == credentialTypeUser {
+		b.testUserRole(ctx, req, name, role, trace)
+	} else {
+		b.testTokenRole(ctx, req, role, trace)
+	}
+
+	return &logical.Response{
+		Data: trace.responseData(),
+	}, nil
+}
+
+// testUserRole issues a user for the role as creds would, checks the claims of
+// its access token and revokes it
+func (b *cognitoSecretBackend) testUserRole(ctx context.Context, req *logical.Request, name string, role *roleEntry, trace *roleTrace) {
+	var resp *logical.Response
+	created := trace.run("create_user", func() (string, error) {
+		var err error
+		resp, err = b.pathCredsRead(ctx, &logical.Request{
+			Operation:   logical.ReadOperation,
+			Path:        "creds/" + name,
+			Storage:     req.Storage,
+			EntityID:    req.EntityID,
+			DisplayName: req.DisplayName,
+			MountPoint:  req.MountPoint,
+			MountType:   req.MountType,
+		}, &framework.FieldData{
+			Raw:    map[string]interface{}{"role": name},
+			Schema: pathCreds(b).Fields,
+		})
+		if err != nil {
+			return "", err
+		}
+		if resp.IsError() {
+			return "", resp.Error()
+		}
+		return fmt.Sprintf("created user %s", resp.Data["username"]), nil
+	})
+	if !created {
+		trace.skip("verify_token", "no user was created")
+		trace.skip("revoke_user", "no user was created")
+		return
+	}
+
+	if accessToken := stringValue(resp.Data["access_token"]); accessToken != "" {
+		trace.run("verify_token", func() (string, error) {
+			return verifyTokenClaims(accessToken, role.AppClientId, role.userGroups())
+		})
+	} else {
+		trace.skip("verify_token", fmt.Sprintf("users provisioned as %s are not signed in", role.provisioningState()))
+	}
+
+	trace.run("revoke_user", func() (string, error) {
+		username := stringValue(resp.Data["username"])
+		if _, err := b.userRevoke(ctx, &logical.Request{
+			Operation: logical.RevokeOperation,
+			Storage:   req.Storage,
+			Secret:    resp.Secret,
+		}, nil); err != nil {
+			return "", err
+		}
+
+		// revocation queues a failed deletion rather than failing
+		entry, err := getRevocationEntry(ctx, req.Storage, userKey(role.Region, role.UserPoolId, username))
+		if err != nil {
+			return "", err
+		}
+		if entry != nil {
+			return "", fmt.Errorf("user %s could not be deleted, the deletion is queued for retry: %s", username, entry.LastError)
+		}
+		return fmt.Sprintf("deleted user %s", username), nil
+	})
+}
+
+// testTokenRole requests a token for the role and checks its claims
+func (b *cognitoSecretBackend) testTokenRole(ctx context.Context, req *logical.Request, role *roleEntry, trace *roleTrace) {
+	client, err := b.getClient(ctx, req)
+	if err != nil {
+		trace.fail("token_endpoint", err)
+		return
+	}
+
+	var rawData map[string]interface{}
+	ok := trace.run("token_endpoint", func() (string, error) {
+		rawData, err = client.getClientCredentialsGrant(ctx, role.CognitoPoolDomain, role.AppClientId, role.AppClientSecret)
+		if err != nil {
+			return "", err
+		}
+		if _, ok := rawData["access_token"]; !ok {
+			return "", fmt.Errorf("the token endpoint did not return a token: %v", rawData["error"])
+		}
+		return "issued a token", nil
+	})
+	if !ok {
+		trace.skip("verify_token", "no token was issued")
+		return
+	}
+
+	trace.run("verify_token", func() (string, error) {
+		return verifyTokenClaims(stringValue(rawData["access_token"]), role.AppClientId, nil)
+	})
+}
+
+// verifyTokenClaims checks that an access token was issued to the app client
+// and carries the groups, and describes its claims. The signature is not
+// verified, as the token was received directly from Cognito.
+func verifyTokenClaims(token string, appClientId string, groups []string) (string, error) {
+	claims, err := tokenClaims(token)
+	if err != nil {
+		return "", err
+	}
+
+	if clientId := stringValue(claims["client_id"]); clientId != appClientId {
+		return "", fmt.Errorf("expected client_id %s, actual: %s", appClientId, clientId)
+	}
+
+	var tokenGroups []string
+	if rawGroups, ok := claims["cognito:groups"].([]interface{}); ok {
+		for _, group := range rawGroups {
+			tokenGroups = append(tokenGroups, stringValue(group))
+		}
+	}
+	for _, group := range groups {
+		if !strutil.StrListContains(tokenGroups, group) {
+			return "", fmt.Errorf("expected the token to have group %s, actual groups: %v", group, tokenGroups)
+		}
+	}
+
+	return fmt.Sprintf("client_id %s, groups %v, scope %s", claims["client_id"], tokenGroups, stringValue(claims["scope"])), nil
+}
+
+// tokenClaims decodes the claims of a JWT without verifying it
+func tokenClaims(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("the token is not a JWT")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errwrap.Wrapf("unable to decode the token: {{err}}", err)
+	}
+
+	var claims map[string]interface{}
+	if err := jsonutil.DecodeJSON(payload, &claims); err != nil {
+		return nil, errwrap.Wrapf("unable to decode the token claims: {{err}}", err)
+	}
+	return claims, nil
+}
+
+// stringValue returns the value of a string or string pointer, the AWS SDK
+// returns tokens as string pointers
+func stringValue(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case *string:
+		if v != nil {
+			return *v
+		}
+	}
+	return ""
+}
+
+// roleTrace records the steps of a role test, with their outcome and timing
+type roleTrace struct {
+	steps  []map[string]interface{}
+	failed bool
+}
+
+// run runs a step, fn returns a description of what the step did, and reports
+// whether the step succeeded
+func (t *roleTrace) run(step string, fn func() (string, error)) bool {
+	start := time.Now()
+	detail, err := fn()
+	duration := time.Since(start).Round(time.Millisecond)
+
+	if err != nil {
+		t.failed = true
+		t.steps = append(t.steps, map[string]interface{}{
+			"step":     step,
+			"status":   "failed",
+			"duration": duration.String(),
+			"detail":   err.Error(),
+		})
+		return false
+	}
+
+	t.steps = append(t.steps, map[string]interface{}{
+		"step":     step,
+		"status":   checkOK,
+		"duration": duration.String(),
+		"detail":   detail,
+	})
+	return true
+}
+
+func (t *roleTrace) fail(step string, err error) {
+	t.run(step, func() (string, error) {
+		return "", err
+	})
+}
+
+func (t *roleTrace) skip(step string, reason string) {
+	t.steps = append(t.steps, map[string]interface{}{
+		"step":   step,
+		"status": "skipped",
+		"detail": reason,
+	})
+}
+
+func (t *roleTrace) responseData() map[string]interface{} {
+	return map[string]interface{}{
+		"success": !t.failed,
+		"steps":   t.steps,
+	}
+}
+
+const pathHealthHelpSyn = `
+Check that every role can issue credentials.
+`
+
+const pathHealthHelpDesc = `
+This path checks every role and reports whether each check passed. For
+user roles the AWS credentials are validated with STS, the user pool and
+app client are described, and the IAM actions used to manage users are
+checked by calling them for a user that does not exist. For client
+credentials roles a token is requested from the token endpoint.
+
+The report is healthy if every check of every role passed.
+`
+
+const pathRoleCheckHelpSyn = `
+Check that a role can issue credentials.
+`
+
+const pathRoleCheckHelpDesc = `
+This path runs the checks of the health path for a single role.
+`
+
+const pathRoleTestHelpSyn = `
+Test a role by issuing and revoking a credential.
+`
+
+const pathRoleTestHelpDesc = `
+Writing to this path issues a credential for the role as creds does and
+returns each step with its outcome and timing.
+
+For user roles a user is created, the claims of its access token are
+checked against the role's app client and groups, and the user is
+revoked. The user counts towards the role's monthly limit.
+
+For client credentials roles a token is requested from the token
+endpoint and its claims are checked against the role's app client.
+`
@@ -0,0 +1,242 @@
+package cognito
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestHealth(t *testing.T) {
+	b, s := getTestBackend(t, true)
+	mc := b.client.(*mockClient)
+
+	testRoleCreate(t, b, s, "user_role", map[string]interface{}{
+		"credential_type": "user",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaa",
+		"group":           "testGroup",
+		"app_client_id":   "testAppClientId",
+	})
+	testRoleCreate(t, b, s, "token_role", map[string]interface{}{
+		"app_client_id":       "testAppClientId",
+		"app_client_secret":   "testAppClientSecret",
+		"cognito_pool_domain": "testCognitoPoolDomain",
+	})
+
+	health := func() map[string]interface{} {
+		t.Helper()
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "health",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		return resp.Data
+	}
+
+	data := health()
+	equal(t, true, data["healthy"])
+	roles := data["roles"].(map[string]interface{})
+	equal(t, map[string]interface{}{
+		"healthy":         true,
+		"credential_type": credentialTypeUser,
+		"checks": map[string]interface{}{
+			checkCredentials:              checkOK,
+			checkDescribeUserPool:         checkOK,
+			checkDescribeUserPoolClient:   checkOK,
+			"cognito-idp:AdminGetUser":    checkOK,
+			"cognito-idp:AdminDeleteUser": checkOK,
+		},
+	}, roles["user_role"])
+	equal(t, map[string]interface{}{
+		"healthy":         true,
+		"credential_type": credentialTypeClientCredentialsGrant,
+		"checks": map[string]interface{}{
+			checkTokenEndpoint: checkOK,
+		},
+	}, roles["token_role"])
+
+	// failed checks are reported with their error
+	mc.appClient = &appClientDetails{ExplicitAuthFlows: []string{"ALLOW_USER_SRP_AUTH"}}
+	mc.actionErrs = map[string]error{
+		"cognito-idp:AdminDeleteUser": logical.CodedError(http.StatusForbidden, "not allowed to call cognito-idp:AdminDeleteUser"),
+	}
+
+	data = health()
+	equal(t, false, data["healthy"])
+	roles = data["roles"].(map[string]interface{})
+	report := roles["user_role"].(map[string]interface{})
+	equal(t, false, report["healthy"])
+	checks := report["checks"].(map[string]interface{})
+	equal(t, "not allowed to call cognito-idp:AdminDeleteUser", checks["cognito-idp:AdminDeleteUser"])
+	equal(t, "app client testAppClientId does not allow the ALLOW_ADMIN_USER_PASSWORD_AUTH flow, which signs in created users", checks[checkDescribeUserPoolClient])
+	equal(t, true, roles["token_role"].(map[string]interface{})["healthy"])
+}
+
+func TestRoleCheck(t *testing.T) {
+	b, s := getTestBackend(t, true)
+	mc := b.client.(*mockClient)
+
+	testRoleCreate(t, b, s, "user_role", map[string]interface{}{
+		"credential_type": "user",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaa",
+		"group":           "testGroup",
+		"app_client_id":   "testAppClientId",
+	})
+
+	// users provisioned without being signed in do not need an app client
+	testRoleCreate(t, b, s, "reset_role", map[string]interface{}{
+		"credential_type":    "user",
+		"region":             "eu-west-1",
+		"user_pool_id":       "eu-west-1_aaaa",
+		"group":              "testGroup",
+		"provisioning_state": "reset_required",
+	})
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "roles/reset_role/check",
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+	equal(t, true, resp.Data["healthy"])
+	if _, ok := resp.Data["checks"].(map[string]interface{})[checkDescribeUserPoolClient]; ok {
+		t.Fatal("expected no app client check")
+	}
+
+	mc.callerIdentityErr = logical.CodedError(http.StatusForbidden, "the security token included in the request is invalid")
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "roles/user_role/check",
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+	equal(t, false, resp.Data["healthy"])
+	equal(t, "the security token included in the request is invalid", resp.Data["checks"].(map[string]interface{})[checkCredentials])
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "roles/missing_role/check",
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+	if !resp.IsError() {
+		t.Fatalf("expected an error response, actual: %#v", resp)
+	}
+}
+
+func TestRoleTest(t *testing.T) {
+	b, s := getTestBackend(t, true)
+	mc := b.client.(*mockClient)
+
+	testRoleCreate(t, b, s, "user_role", map[string]interface{}{
+		"credential_type": "user",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaa",
+		"app_client_id":   "testAppClientId",
+		"group":           "testers",
+	})
+
+	roleTest := func(name string) map[string]interface{} {
+		t.Helper()
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "roles/" + name + "/test",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		return resp.Data
+	}
+
+	stepStatuses := func(data map[string]interface{}) map[string]string {
+		statuses := make(map[string]string)
+		for _, step := range data["steps"].([]map[string]interface{}) {
+			statuses[step["step"].(string)] = step["status"].(string)
+		}
+		return statuses
+	}
+
+	mc.accessToken = testJWT(t, map[string]interface{}{
+		"client_id":      "testAppClientId",
+		"cognito:groups": []string{"testers"},
+		"scope":          "aws.cognito.signin.user.admin",
+	})
+	data := roleTest("user_role")
+	equal(t, true, data["success"])
+	equal(t, map[string]string{
+		"create_user":  checkOK,
+		"verify_token": checkOK,
+		"revoke_user":  checkOK,
+	}, stepStatuses(data))
+
+	// the user is revoked
+	equal(t, 1, len(mc.deletedUsers))
+	users, err := listUserEntries(context.Background(), s)
+	assertErrorIsNil(t, err)
+	equal(t, 0, len(users))
+
+	// a token without the role's groups fails verification, the user is still
+	// revoked
+	mc.accessToken = testJWT(t, map[string]interface{}{
+		"client_id": "testAppClientId",
+	})
+	data = roleTest("user_role")
+	equal(t, false, data["success"])
+	equal(t, map[string]string{
+		"create_user":  checkOK,
+		"verify_token": "failed",
+		"revoke_user":  checkOK,
+	}, stepStatuses(data))
+	equal(t, 2, len(mc.deletedUsers))
+
+	// a failed creation skips the later steps
+	mc.newUserErr = logical.CodedError(http.StatusBadRequest, "Could not create user: check the role's region, user_pool_id, app_client_id and groups")
+	data = roleTest("user_role")
+	equal(t, false, data["success"])
+	equal(t, map[string]string{
+		"create_user":  "failed",
+		"verify_token": "skipped",
+		"revoke_user":  "skipped",
+	}, stepStatuses(data))
+}
+
+func TestRoleTestClientCredentials(t *testing.T) {
+	b, s := getTestBackend(t, true)
+	mc := b.client.(*mockClient)
+
+	testRoleCreate(t, b, s, "token_role", map[string]interface{}{
+		"app_client_id":       "testAppClientId",
+		"app_client_secret":   "testAppClientSecret",
+		"cognito_pool_domain": "testCognitoPoolDomain",
+	})
+
+	mc.accessToken = testJWT(t, map[string]interface{}{
+		"client_id": "otherAppClientId",
+	})
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.UpdateOperation,
+		Path:      "roles/token_role/test",
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+	equal(t, false, resp.Data["success"])
+	steps := resp.Data["steps"].([]map[string]interface{})
+	equal(t, checkOK, steps[0]["status"])
+	equal(t, "expected client_id testAppClientId, actual: otherAppClientId", steps[1]["detail"])
+}
+
+// testJWT returns an unsigned JWT with the claims
+func testJWT(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+
+	payload, err := json.Marshal(claims)
+	assertErrorIsNil(t, err)
+	return "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString(payload) + ".c2lnbmF0dXJl"
+}
@@ -0,0 +1,278 @@
+package cognito
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	revocationsStoragePath = "revocations"
+
+	revocationInitialBackoff = time.Minute
+	revocationMaxBackoff     = time.Hour
+)
+
+// revocationEntry records a user whose deletion failed when its lease was
+// revoked, the deletion is retried with backoff by the periodic function.
+type revocationEntry struct {
+	Username    string    `json:"username"`
+	Role        string    `json:"role"`
+	Region      string    `json:"region"`
+	UserPoolId  string    `json:"user_pool_id"`
+	Attempts    int       `json:"attempts"`
+	LastError   string    `json:"last_error"`
+	CreateTime  time.Time `json:"create_time"`
+	NextAttempt time.Time `json:"next_attempt"`
+}
+
+func pathsRevocations(b *cognitoSecretBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "revocations/?$",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathRevocationsList,
+			},
+			HelpSynopsis:    revocationsListHelpSyn,
+			HelpDescription: revocationsListHelpDesc,
+		},
+		{
+			Pattern: "revocations/" + framework.GenericNameRegex("region") + "/" + framework.GenericNameRegex("user_pool_id") + "/" + framework.MatchAllRegex("username"),
+			Fields: map[string]*framework.FieldSchema{
+				"region": {
+					Type:        framework.TypeString,
+					Description: "Region of the user pool.",
+				},
+				"user_pool_id": {
+					Type:        framework.TypeString,
+					Description: "ID of the user pool.",
+				},
+				"username": {
+					Type:        framework.TypeString,
+					Description: "Username of the user.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation:   b.pathRevocationRead,
+				logical.DeleteOperation: b.pathRevocationDelete,
+			},
+			HelpSynopsis:    revocationHelpSyn,
+			HelpDescription: revocationHelpDesc,
+		},
+	}
+}
+
+func (b *cognitoSecretBackend) pathRevocationsList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	keys, err := listRevocationEntries(ctx, req.Storage)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing revocations: {{err}}", err)
+	}
+
+	keyInfo := make(map[string]interface{}, len(keys))
+	for _, key := range keys {
+		entry, err := getRevocationEntry(ctx, req.Storage, key)
+		if err != nil {
+			return nil, errwrap.Wrapf("error reading revocation: {{err}}", err)
+		}
+
+		if entry != nil {
+			keyInfo[key] = entry.responseData()
+		}
+	}
+
+	return logical.ListResponseWithInfo(keys, keyInfo), nil
+}
+
+// revocationKey returns the key of the revocation requested by the path, see userKey
+func revocationKey(d *framework.FieldData) string {
+	return userKey(d.Get("region").(string), d.Get("user_pool_id").(string), d.Get("username").(string))
+}
+
+func (b *cognitoSecretBackend) pathRevocationRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	entry, err := getRevocationEntry(ctx, req.Storage, revocationKey(d))
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading revocation: {{err}}", err)
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	return &logical.Response{
+		Data: entry.responseData(),
+	}, nil
+}
+
+func (b *cognitoSecretBackend) pathRevocationDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	err := deleteRevocationEntry(ctx, req.Storage, revocationKey(d))
+	if err != nil {
+		return nil, errwrap.Wrapf("error deleting revocation: {{err}}", err)
+	}
+
+	return nil, nil
+}
+
+func (e *revocationEntry) responseData() map[string]interface{} {
+	return map[string]interface{}{
+		"username":     e.Username,
+		"role":         e.Role,
+		"region":       e.Region,
+		"user_pool_id": e.UserPoolId,
+		"attempts":     e.Attempts,
+		"last_error":   e.LastError,
+		"create_time":  formatTime(e.CreateTime),
+		"next_attempt": formatTime(e.NextAttempt),
+	}
+}
+
+// queueRevocation records a failed deletion so that it is retried after a backoff
+func queueRevocation(ctx context.Context, s logical.Storage, e *revocationEntry, deleteErr error, now time.Time) error {
+	if e.CreateTime.IsZero() {
+		e.CreateTime = now.UTC()
+	}
+	e.Attempts++
+	e.LastError = deleteErr.Error()
+	e.NextAttempt = now.UTC().Add(revocationBackoff(e.Attempts))
+
+	return saveRevocationEntry(ctx, s, e)
+}
+
+// revocationBackoff returns the delay before retrying a deletion that has failed
+// the given number of times, doubling from revocationInitialBackoff up to
+// revocationMaxBackoff.
+func revocationBackoff(attempts int) time.Duration {
+	backoff := revocationInitialBackoff
+	for i := 1; i < attempts && backoff < revocationMaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > revocationMaxBackoff {
+		backoff = revocationMaxBackoff
+	}
+	return backoff
+}
+
+// processRevocations retries the queued deletions that are due, a deletion is
+// removed from the queue once it succeeds.
+func (b *cognitoSecretBackend) processRevocations(ctx context.Context, req *logical.Request) error {
+	keys, err := listRevocationEntries(ctx, req.Storage)
+	if err != nil {
+		return errwrap.Wrapf("error listing revocations: {{err}}", err)
+	}
+
+	if len(keys) == 0 {
+		return nil
+	}
+
+	client, err := b.getClient(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, key := range keys {
+		entry, err := getRevocationEntry(ctx, req.Storage, key)
+		if err != nil {
+			return errwrap.Wrapf("error reading revocation: {{err}}", err)
+		}
+
+		if entry == nil || entry.NextAttempt.After(now) {
+			continue
+		}
+
+		err = client.deleteUser(ctx, entry.Region, entry.UserPoolId, entry.Username)
+		recordRevocationRetry(entry.Role, err)
+		if err != nil {
+			b.Logger().Warn("failed to retry revocation", "username", entry.Username, "attempts", entry.Attempts+1, "error", err)
+			if err := queueRevocation(ctx, req.Storage, entry, err, now); err != nil {
+				return errwrap.Wrapf("error storing revocation: {{err}}", err)
+			}
+			continue
+		}
+
+		b.Logger().Info("retried revocation", "username", entry.Username, "attempts", entry.Attempts+1)
+		if err := deleteRevocationEntry(ctx, req.Storage, key); err != nil {
+			return errwrap.Wrapf("error deleting revocation: {{err}}", err)
+		}
+	}
+
+	return nil
+}
+
+func (e *revocationEntry) key() string {
+	return userKey(e.Region, e.UserPoolId, e.Username)
+}
+
+func saveRevocationEntry(ctx context.Context, s logical.Storage, e *revocationEntry) error {
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", revocationsStoragePath, e.key()), e)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+func getRevocationEntry(ctx context.Context, s logical.Storage, key string) (*revocationEntry, error) {
+	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", revocationsStoragePath, key))
+	if err != nil {
+		return nil, err
+	}
+
+	if entry == nil {
+		return nil, nil
+	}
+
+	e := new(revocationEntry)
+	if err := entry.DecodeJSON(e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func deleteRevocationEntry(ctx context.Context, s logical.Storage, key string) error {
+	return s.Delete(ctx, fmt.Sprintf("%s/%s", revocationsStoragePath, key))
+}
+
+// listRevocationEntries returns the keys of the queued revocations, see userKey
+func listRevocationEntries(ctx context.Context, s logical.Storage) ([]string, error) {
+	keys, err := logical.CollectKeys(ctx, logical.NewStorageView(s, revocationsStoragePath+"/"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+const revocationsListHelpSyn = `
+List the users whose deletion failed and is being retried.
+`
+
+const revocationsListHelpDesc = `
+When a user cannot be deleted as its lease is revoked, e.g. because Cognito
+is throttling requests or the AWS credentials have expired, the lease is
+revoked and the deletion is queued. Queued deletions are retried with a
+backoff, starting at 1 minute and doubling up to 1 hour, until they succeed.
+
+This path lists the queued deletions as <region>/<user_pool_id>/<username>,
+along with the number of attempts, the last error and when the deletion will
+next be retried.
+`
+
+const revocationHelpSyn = `
+Read or discard a queued user deletion.
+`
+
+const revocationHelpDesc = `
+Reading this path returns a queued deletion. Deleting this path removes the
+deletion from the queue, so that it is no longer retried, e.g. once the user
+has been deleted by hand.
+
+A queued user no longer has a lease, so tidy may delete it as an orphan before
+the deletion is retried, if its role records the role and mount metadata
+attributes. The retry then finds the user already deleted and removes it from
+the queue. A user that is no longer retried is also left for tidy to delete.
+`
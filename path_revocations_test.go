@@ -0,0 +1,187 @@
+package cognito
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRevocationQueue(t *testing.T) {
+	b, s := getTestBackend(t, true)
+	mc := b.client.(*mockClient)
+
+	testRoleCreate(t, b, s, "test_role", map[string]interface{}{
+		"credential_type": "user",
+		"app_client_id":   "testAppClientId",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaa",
+		"group":           "testGroup",
+	})
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/test_role",
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+	username := resp.Data["username"].(string)
+	key := userKey("eu-west-1", "eu-west-1_aaaa", username)
+
+	// a failed deletion does not fail the revocation, it is queued
+	mc.deleteUserErr = errors.New("TooManyRequestsException: Rate exceeded")
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    resp.Secret,
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "revocations",
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+	equal(t, []string{key}, resp.Data["keys"])
+	info := resp.Data["key_info"].(map[string]interface{})[key].(map[string]interface{})
+	equal(t, 1, info["attempts"])
+	equal(t, "eu-west-1_aaaa", info["user_pool_id"])
+	equal(t, "TooManyRequestsException: Rate exceeded", info["last_error"])
+
+	periodic := func() {
+		t.Helper()
+		assertErrorIsNil(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+	}
+
+	// deletions are not retried until the backoff has passed
+	mc.deleteUserErr = nil
+	periodic()
+	entry, err := getRevocationEntry(context.Background(), s, key)
+	assertErrorIsNil(t, err)
+	equal(t, 1, entry.Attempts)
+	equal(t, 0, len(mc.deletedUsers))
+
+	// failed retries back off further
+	mc.deleteUserErr = errors.New("ExpiredTokenException")
+	entry.NextAttempt = time.Now().Add(-time.Second)
+	assertErrorIsNil(t, saveRevocationEntry(context.Background(), s, entry))
+	periodic()
+	entry, err = getRevocationEntry(context.Background(), s, key)
+	assertErrorIsNil(t, err)
+	equal(t, 2, entry.Attempts)
+	equal(t, "ExpiredTokenException", entry.LastError)
+	if entry.NextAttempt.Sub(time.Now()).Round(time.Minute) != 2*time.Minute {
+		t.Fatalf("expected the next attempt in 2 minutes, actual: %s", entry.NextAttempt)
+	}
+
+	// successful retries are removed from the queue
+	mc.deleteUserErr = nil
+	entry.NextAttempt = time.Now().Add(-time.Second)
+	assertErrorIsNil(t, saveRevocationEntry(context.Background(), s, entry))
+	periodic()
+	equal(t, []string{username}, mc.deletedUsers)
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "revocations/" + key,
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+	if resp != nil {
+		t.Fatalf("expected the revocation to be removed, actual: %#v", resp)
+	}
+}
+
+func TestRevocationOfPartlyCreatedUser(t *testing.T) {
+	b, s := getTestBackend(t, true)
+	mc := b.client.(*mockClient)
+
+	testRoleCreate(t, b, s, "test_role", map[string]interface{}{
+		"credential_type": "user",
+		"app_client_id":   "testAppClientId",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaa",
+		"group":           "testGroup",
+	})
+
+	// the user was created, but neither added to its group nor deleted
+	mc.newUserErr = &userNotDeletedError{
+		Username:  "vault12345",
+		Err:       errors.New("Could not add user to group testGroup"),
+		DeleteErr: errors.New("TooManyRequestsException: Rate exceeded"),
+	}
+	_, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "creds/test_role",
+		Storage:   s,
+	})
+	if err == nil || err.Error() != "Could not add user to group testGroup" {
+		t.Fatalf("expected the group error, actual: %v", err)
+	}
+
+	entry, err := getRevocationEntry(context.Background(), s, userKey("eu-west-1", "eu-west-1_aaaa", "vault12345"))
+	assertErrorIsNil(t, err)
+	if entry == nil {
+		t.Fatal("expected the user to be queued for revocation")
+	}
+	equal(t, "test_role", entry.Role)
+	equal(t, "eu-west-1_aaaa", entry.UserPoolId)
+	equal(t, "TooManyRequestsException: Rate exceeded", entry.LastError)
+
+	entry.NextAttempt = time.Now().Add(-time.Second)
+	assertErrorIsNil(t, saveRevocationEntry(context.Background(), s, entry))
+	assertErrorIsNil(t, b.periodicFunc(context.Background(), &logical.Request{Storage: s}))
+	equal(t, []string{"vault12345"}, mc.deletedUsers)
+}
+
+func TestRevocationDelete(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	err := queueRevocation(context.Background(), s, &revocationEntry{
+		Username:   "vault-user@example.com",
+		Role:       "test_role",
+		Region:     "eu-west-1",
+		UserPoolId: "eu-west-1_aaaa",
+	}, errors.New("AccessDeniedException"), time.Now())
+	assertErrorIsNil(t, err)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "revocations/eu-west-1/eu-west-1_aaaa/vault-user@example.com",
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+	equal(t, "test_role", resp.Data["role"])
+	equal(t, "AccessDeniedException", resp.Data["last_error"])
+
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.DeleteOperation,
+		Path:      "revocations/eu-west-1/eu-west-1_aaaa/vault-user@example.com",
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+
+	entry, err := getRevocationEntry(context.Background(), s, userKey("eu-west-1", "eu-west-1_aaaa", "vault-user@example.com"))
+	assertErrorIsNil(t, err)
+	if entry != nil {
+		t.Fatalf("expected the revocation to be deleted, actual: %#v", entry)
+	}
+}
+
+func TestRevocationBackoff(t *testing.T) {
+	tests := map[int]time.Duration{
+		1:   time.Minute,
+		2:   2 * time.Minute,
+		3:   4 * time.Minute,
+		6:   32 * time.Minute,
+		7:   time.Hour,
+		100: time.Hour,
+	}
+
+	for attempts, expected := range tests {
+		equal(t, expected, revocationBackoff(attempts))
+	}
+}
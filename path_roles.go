@@ -4,10 +4,14 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/errwrap"
+	multierror "github.com/hashicorp/go-multierror"
 	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/helper/strutil"
 	"github.com/hashicorp/vault/sdk/logical"
 )
 
@@ -16,8 +20,69 @@ const (
 
 	credentialTypeClientCredentialsGrant = "client_credentials_grant"
 	credentialTypeUser                   = "user"
+
+	provisioningStateConfirmed           = "confirmed"
+	provisioningStateForceChangePassword = "force_change_password"
+	provisioningStateUnconfirmed         = "unconfirmed"
+	provisioningStateResetRequired       = "reset_required"
+
+	// deletionPolicySnapshot deletes the role and leaves the users to be revoked
+	// when their leases expire, using the user pool recorded in each lease
+	deletionPolicySnapshot = "snapshot"
+	// deletionPolicyRefuse prevents the role from being deleted while it has users
+	// with an active lease
+	deletionPolicyRefuse = "refuse"
+	// deletionPolicyRevoke deletes the role's users when the role is deleted, their
+	// leases remain until they expire or are revoked, as a plugin cannot revoke
+	// leases
+	deletionPolicyRevoke = "revoke"
+
+	metadataRole      = "role"
+	metadataEntity    = "entity"
+	metadataMount     = "mount"
+	metadataExpiresAt = "expires_at"
+
+	// vaultEmailPrefix is the prefix of the email addresses generated by the default template
+	vaultEmailPrefix = "vault"
+	// defaultEmailLocalTemplate is used when the role has no dummy email domain
+	defaultEmailLocalTemplate = vaultEmailPrefix + `{{slice (uuid) 5}}`
+	defaultEmailTemplate      = defaultEmailLocalTemplate + `@{{.DummyEmailDomain}}`
+	defaultUsernameTemplate   = `{{.Email}}`
+	// defaultPhoneNumberTemplate generates numbers in the UK range reserved for drama
+	defaultPhoneNumberTemplate = `+447700900{{random_digits 3}}`
+
+	// defaultProviderAttributeName links users by the subject of the SAML
+	// assertion or OIDC token
+	defaultProviderAttributeName   = "Cognito_Subject"
+	defaultProviderSubjectTemplate = `{{.Email}}`
 )
 
+// provisioningStates are the states that a created user can be left in
+var provisioningStates = []string{provisioningStateConfirmed, provisioningStateForceChangePassword, provisioningStateUnconfirmed, provisioningStateResetRequired}
+
+// deletionPolicies are the ways that the users of a role can be handled when the role is deleted
+var deletionPolicies = []string{deletionPolicySnapshot, deletionPolicyRefuse, deletionPolicyRevoke}
+
+// metadataKeys are the lease metadata values that can be written to user attributes
+var metadataKeys = []string{metadataRole, metadataEntity, metadataMount, metadataExpiresAt}
+
+// credentialTypes are the types of credentials that a role can issue
+var credentialTypes = []string{credentialTypeClientCredentialsGrant, credentialTypeUser}
+
+// userRoleFields are the role fields that only apply to user roles
+var userRoleFields = []string{
+	"region", "user_pool_id", "group", "groups", "allowed_groups", "dummy_email_domain",
+	"metadata_attributes", "user_attributes", "client_metadata",
+	"username_template", "email_template", "phone_number_template", "password_policy",
+	"allowed_attributes", "max_username_suffix_length", "provisioning_state", "send_invitation",
+	"provider_name", "provider_attribute_name", "provider_subject_template",
+	"max_active_users", "max_users_per_month", "deletion_policy", "ttl", "max_ttl",
+}
+
+// clientCredentialsRoleFields are the role fields that only apply to client
+// credentials grant roles
+var clientCredentialsRoleFields = []string{"cognito_pool_domain"}
+
 // roleEntry is a Vault role construct that maps to cognito configuration
 type roleEntry struct {
 	CredentialType    string        `json:"credential_type"`
@@ -27,9 +92,44 @@ type roleEntry struct {
 	AppClientId       string        `json:"app_client_id"`
 	UserPoolId        string        `json:"user_pool_id"`
 	Group             string        `json:"group"`
+	Groups            []string      `json:"groups"`
+	AllowedGroups     []string      `json:"allowed_groups"`
 	DummyEmailDomain  string        `json:"dummy_email_domain"`
 	TTL               time.Duration `json:"ttl"`
 	MaxTTL            time.Duration `json:"max_ttl"`
+
+	// MetadataAttributes maps lease metadata to the user attributes it is written to
+	MetadataAttributes map[string]string `json:"metadata_attributes"`
+	// UserAttributes maps user attributes to the templates that generate their values
+	UserAttributes map[string]string `json:"user_attributes"`
+	// ClientMetadata maps client metadata keys to the templates that generate
+	// their values, it is passed to the Lambda triggers of the user pool
+	ClientMetadata map[string]string `json:"client_metadata"`
+
+	UsernameTemplate    string `json:"username_template"`
+	EmailTemplate       string `json:"email_template"`
+	PhoneNumberTemplate string `json:"phone_number_template"`
+	PasswordPolicy      string `json:"password_policy"`
+
+	// AllowedAttributes are the user attributes that can be set when requesting credentials
+	AllowedAttributes       []string `json:"allowed_attributes"`
+	MaxUsernameSuffixLength int      `json:"max_username_suffix_length"`
+
+	ProvisioningState string `json:"provisioning_state"`
+	SendInvitation    bool   `json:"send_invitation"`
+
+	// ProviderName is the identity provider that created users are linked to,
+	// users are not linked if it is not set
+	ProviderName            string `json:"provider_name"`
+	ProviderAttributeName   string `json:"provider_attribute_name"`
+	ProviderSubjectTemplate string `json:"provider_subject_template"`
+
+	// MaxActiveUsers and MaxUsersPerMonth limit the users created for the role,
+	// 0 means unlimited
+	MaxActiveUsers   int `json:"max_active_users"`
+	MaxUsersPerMonth int `json:"max_users_per_month"`
+
+	DeletionPolicy string `json:"deletion_policy"`
 }
 
 func pathsRole(b *cognitoSecretBackend) []*framework.Path {
@@ -67,11 +167,87 @@ func pathsRole(b *cognitoSecretBackend) []*framework.Path {
 				},
 				"group": {
 					Type:        framework.TypeString,
-					Description: fmt.Sprintf("The group to add the created user to (for %s)", credentialTypeUser),
+					Description: fmt.Sprintf("The group to add the created user to, group or groups must be set (for %s)", credentialTypeUser),
+				},
+				"groups": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: fmt.Sprintf("The groups to add the created user to, in addition to group (for %s)", credentialTypeUser),
+				},
+				"allowed_groups": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: fmt.Sprintf("The groups that can be chosen when requesting credentials, if not set the role's groups can be chosen (for %s)", credentialTypeUser),
 				},
 				"dummy_email_domain": {
 					Type:        framework.TypeString,
-					Description: fmt.Sprintf("A dummy email domain used in the username when creating a user (for %s)", credentialTypeUser),
+					Description: fmt.Sprintf("A dummy email domain used in the username when creating a user, the email is only set on the user if the user pool uses email or the role sets dummy_email_domain or email_template (for %s)", credentialTypeUser),
+				},
+				"metadata_attributes": {
+					Type:        framework.TypeKVPairs,
+					Description: fmt.Sprintf("The user attributes to write lease metadata to, keyed by one of %s, e.g. role=custom:vault_role (for %s)", strings.Join(metadataKeys, ", "), credentialTypeUser),
+				},
+				"user_attributes": {
+					Type:        framework.TypeKVPairs,
+					Description: fmt.Sprintf("User attributes to set on the created user, the values are templates that can reference the role name and the requesting identity entity, e.g. custom:tenant_id={{index .Entity.Metadata \"tenant_id\"}} (for %s)", credentialTypeUser),
+				},
+				"client_metadata": {
+					Type:        framework.TypeKVPairs,
+					Description: fmt.Sprintf("Client metadata to pass to the Lambda triggers of the user pool when creating and authenticating the user, the values are templates that can reference the role name and the lease, e.g. vault_role={{.RoleName}} (for %s)", credentialTypeUser),
+				},
+				"username_template": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The template used to generate the username of the created user, defaults to the email address (for %s)", credentialTypeUser),
+				},
+				"email_template": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The template used to generate the email address of the created user, defaults to a random address in the dummy email domain (for %s)", credentialTypeUser),
+				},
+				"phone_number_template": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The template used to generate the phone number of the created user when the user pool uses phone numbers, defaults to a random number in a reserved range (for %s)", credentialTypeUser),
+				},
+				"password_policy": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The name of the Vault password policy used to generate passwords, if not set a random password that satisfies the user pool password policy is generated (for %s)", credentialTypeUser),
+				},
+				"allowed_attributes": {
+					Type:        framework.TypeCommaStringSlice,
+					Description: fmt.Sprintf("The user attributes that can be set when requesting credentials, supports globs, e.g. custom:* (for %s)", credentialTypeUser),
+				},
+				"max_username_suffix_length": {
+					Type:        framework.TypeInt,
+					Description: fmt.Sprintf("The maximum length of the username suffix that can be set when requesting credentials, if not set or set to 0 a suffix cannot be set (for %s)", credentialTypeUser),
+				},
+				"provisioning_state": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The state to leave the created user in, one of %s, defaults to %s (for %s)", strings.Join(provisioningStates, ", "), provisioningStateConfirmed, credentialTypeUser),
+				},
+				"send_invitation": {
+					Type:        framework.TypeBool,
+					Description: fmt.Sprintf("Send the Cognito invitation message to the created user rather than suppressing it (for %s)", credentialTypeUser),
+				},
+				"provider_name": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The name of the SAML or OIDC identity provider of the user pool to link the created user to, if not set the user is not linked (for %s)", credentialTypeUser),
+				},
+				"provider_attribute_name": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The provider attribute that identifies the linked identity, defaults to %s (for %s)", defaultProviderAttributeName, credentialTypeUser),
+				},
+				"provider_subject_template": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("The template used to generate the value of the provider attribute of the linked identity, defaults to the email address (for %s)", credentialTypeUser),
+				},
+				"max_active_users": {
+					Type:        framework.TypeInt,
+					Description: fmt.Sprintf("The maximum number of users with an active lease, if not set or set to 0 the number is not limited (for %s)", credentialTypeUser),
+				},
+				"max_users_per_month": {
+					Type:        framework.TypeInt,
+					Description: fmt.Sprintf("The maximum number of users created in a calendar month, if not set or set to 0 the number is not limited (for %s)", credentialTypeUser),
+				},
+				"deletion_policy": {
+					Type:        framework.TypeString,
+					Description: fmt.Sprintf("How users with an active lease are handled when the role is deleted, one of %s, defaults to %s. With %s the users are deleted but their leases remain until they expire, revoke them with 'vault lease revoke -prefix <mount>/creds/<role>' (for %s)", strings.Join(deletionPolicies, ", "), deletionPolicySnapshot, deletionPolicyRevoke, credentialTypeUser),
 				},
 				"ttl": {
 					Type:        framework.TypeDurationSecond,
@@ -81,6 +257,10 @@ func pathsRole(b *cognitoSecretBackend) []*framework.Path {
 					Type:        framework.TypeDurationSecond,
 					Description: fmt.Sprintf("Maximum time a service principal. If not set or set to 0, will use system default (for %s)", credentialTypeUser),
 				},
+				"validate_remote": {
+					Type:        framework.TypeBool,
+					Description: fmt.Sprintf("Check that the user pool, app client and groups exist, or for %s that the token endpoint issues a token, before saving the role", credentialTypeClientCredentialsGrant),
+				},
 			},
 			Callbacks: map[logical.Operation]framework.OperationFunc{
 				logical.ReadOperation:   b.pathRoleRead,
@@ -124,7 +304,15 @@ func (b *cognitoSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.
 			return nil, errors.New("role entry not found during update operation")
 		}
 		role = &roleEntry{
-			CredentialType: credentialTypeClientCredentialsGrant,
+			CredentialType:      credentialTypeClientCredentialsGrant,
+			UsernameTemplate:    defaultUsernameTemplate,
+			EmailTemplate:       defaultEmailTemplate,
+			PhoneNumberTemplate: defaultPhoneNumberTemplate,
+			ProvisioningState:   provisioningStateConfirmed,
+
+			ProviderAttributeName:   defaultProviderAttributeName,
+			ProviderSubjectTemplate: defaultProviderSubjectTemplate,
+			DeletionPolicy:          deletionPolicySnapshot,
 		}
 	}
 
@@ -158,10 +346,137 @@ func (b *cognitoSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.
 		role.Group = group.(string)
 	}
 
+	if groups, ok := d.GetOk("groups"); ok {
+		role.Groups = groups.([]string)
+	}
+
+	if allowedGroups, ok := d.GetOk("allowed_groups"); ok {
+		role.AllowedGroups = allowedGroups.([]string)
+	}
+
 	if dummyEmailDomain, ok := d.GetOk("dummy_email_domain"); ok {
 		role.DummyEmailDomain = dummyEmailDomain.(string)
 	}
 
+	if metadataAttributes, ok := d.GetOk("metadata_attributes"); ok {
+		role.MetadataAttributes = metadataAttributes.(map[string]string)
+		for key := range role.MetadataAttributes {
+			if !strutil.StrListContains(metadataKeys, key) {
+				return logical.ErrorResponse(fmt.Sprintf("unsupported metadata_attributes key '%s', must be one of %s", key, strings.Join(metadataKeys, ", "))), nil
+			}
+		}
+	}
+
+	if userAttributes, ok := d.GetOk("user_attributes"); ok {
+		role.UserAttributes = userAttributes.(map[string]string)
+		for name, rawTemplate := range role.UserAttributes {
+			if _, err := parseTemplate(rawTemplate); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("invalid template for user attribute '%s': %s", name, err)), nil
+			}
+		}
+	}
+
+	if clientMetadata, ok := d.GetOk("client_metadata"); ok {
+		role.ClientMetadata = clientMetadata.(map[string]string)
+		for key, rawTemplate := range role.ClientMetadata {
+			if _, err := parseTemplate(rawTemplate); err != nil {
+				return logical.ErrorResponse(fmt.Sprintf("invalid template for client metadata '%s': %s", key, err)), nil
+			}
+		}
+	}
+
+	if usernameTemplate, ok := d.GetOk("username_template"); ok {
+		role.UsernameTemplate = usernameTemplate.(string)
+		if _, err := parseTemplate(role.UsernameTemplate); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid username_template: %s", err)), nil
+		}
+	}
+
+	if emailTemplate, ok := d.GetOk("email_template"); ok {
+		role.EmailTemplate = emailTemplate.(string)
+		if _, err := parseTemplate(role.EmailTemplate); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid email_template: %s", err)), nil
+		}
+	}
+
+	if phoneNumberTemplate, ok := d.GetOk("phone_number_template"); ok {
+		role.PhoneNumberTemplate = phoneNumberTemplate.(string)
+		if _, err := parseTemplate(role.PhoneNumberTemplate); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid phone_number_template: %s", err)), nil
+		}
+	}
+
+	if passwordPolicy, ok := d.GetOk("password_policy"); ok {
+		role.PasswordPolicy = passwordPolicy.(string)
+	}
+
+	if allowedAttributes, ok := d.GetOk("allowed_attributes"); ok {
+		role.AllowedAttributes = allowedAttributes.([]string)
+	}
+
+	if maxUsernameSuffixLength, ok := d.GetOk("max_username_suffix_length"); ok {
+		role.MaxUsernameSuffixLength = maxUsernameSuffixLength.(int)
+		if role.MaxUsernameSuffixLength < 0 {
+			return logical.ErrorResponse("max_username_suffix_length cannot be negative"), nil
+		}
+	}
+
+	if provisioningState, ok := d.GetOk("provisioning_state"); ok {
+		role.ProvisioningState = provisioningState.(string)
+		if !strutil.StrListContains(provisioningStates, role.ProvisioningState) {
+			return logical.ErrorResponse(fmt.Sprintf("unsupported provisioning_state '%s', must be one of %s", role.ProvisioningState, strings.Join(provisioningStates, ", "))), nil
+		}
+	}
+
+	if sendInvitation, ok := d.GetOk("send_invitation"); ok {
+		role.SendInvitation = sendInvitation.(bool)
+	}
+
+	if providerName, ok := d.GetOk("provider_name"); ok {
+		role.ProviderName = providerName.(string)
+		if role.ProviderName == cognitoProviderName {
+			return logical.ErrorResponse(fmt.Sprintf("provider_name cannot be %s, it must be a SAML or OIDC identity provider", cognitoProviderName)), nil
+		}
+	}
+
+	if providerAttributeName, ok := d.GetOk("provider_attribute_name"); ok {
+		role.ProviderAttributeName = providerAttributeName.(string)
+	}
+
+	if providerSubjectTemplate, ok := d.GetOk("provider_subject_template"); ok {
+		role.ProviderSubjectTemplate = providerSubjectTemplate.(string)
+		if _, err := parseTemplate(role.ProviderSubjectTemplate); err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("invalid provider_subject_template: %s", err)), nil
+		}
+	}
+
+	if maxActiveUsers, ok := d.GetOk("max_active_users"); ok {
+		role.MaxActiveUsers = maxActiveUsers.(int)
+		if role.MaxActiveUsers < 0 {
+			return logical.ErrorResponse("max_active_users cannot be negative"), nil
+		}
+	}
+
+	if maxUsersPerMonth, ok := d.GetOk("max_users_per_month"); ok {
+		role.MaxUsersPerMonth = maxUsersPerMonth.(int)
+		if role.MaxUsersPerMonth < 0 {
+			return logical.ErrorResponse("max_users_per_month cannot be negative"), nil
+		}
+	}
+
+	if deletionPolicy, ok := d.GetOk("deletion_policy"); ok {
+		role.DeletionPolicy = deletionPolicy.(string)
+		if !strutil.StrListContains(deletionPolicies, role.DeletionPolicy) {
+			return logical.ErrorResponse(fmt.Sprintf("unsupported deletion_policy '%s', must be one of %s", role.DeletionPolicy, strings.Join(deletionPolicies, ", "))), nil
+		}
+	}
+
+	for _, attribute := range role.MetadataAttributes {
+		if _, ok := role.UserAttributes[attribute]; ok {
+			return logical.ErrorResponse(fmt.Sprintf("user attribute '%s' cannot be in both metadata_attributes and user_attributes", attribute)), nil
+		}
+	}
+
 	// load and validate TTLs
 	if ttlRaw, ok := d.GetOk("ttl"); ok {
 		role.TTL = time.Duration(ttlRaw.(int)) * time.Second
@@ -179,6 +494,24 @@ func (b *cognitoSecretBackend) pathRoleUpdate(ctx context.Context, req *logical.
 		return logical.ErrorResponse("ttl cannot be greater than max_ttl"), nil
 	}
 
+	if err := validateRole(role, d); err != nil {
+		return logical.ErrorResponse(err.Error()), nil
+	}
+
+	if d.Get("validate_remote").(bool) {
+		warnings, err := b.validateRoleRemote(ctx, req, role)
+		if err != nil {
+			return logical.ErrorResponse(fmt.Sprintf("validate_remote: %s", err)), nil
+		}
+
+		for _, warning := range warnings {
+			if resp == nil {
+				resp = new(logical.Response)
+			}
+			resp.AddWarning(warning)
+		}
+	}
+
 	// save role
 	err = saveRole(ctx, req.Storage, role, name)
 	if err != nil {
@@ -208,11 +541,31 @@ func (b *cognitoSecretBackend) pathRoleRead(ctx context.Context, req *logical.Re
 		data["app_client_id"] = r.AppClientId
 		data["user_pool_id"] = r.UserPoolId
 		data["group"] = r.Group
+		data["groups"] = stringSlice(r.Groups)
+		data["allowed_groups"] = stringSlice(r.AllowedGroups)
 		data["dummy_email_domain"] = r.DummyEmailDomain
+		data["metadata_attributes"] = stringMap(r.MetadataAttributes)
+		data["user_attributes"] = stringMap(r.UserAttributes)
+		data["client_metadata"] = stringMap(r.ClientMetadata)
+		data["username_template"] = r.UsernameTemplate
+		data["email_template"] = r.EmailTemplate
+		data["phone_number_template"] = r.PhoneNumberTemplate
+		data["password_policy"] = r.PasswordPolicy
+		data["allowed_attributes"] = stringSlice(r.AllowedAttributes)
+		data["max_username_suffix_length"] = r.MaxUsernameSuffixLength
+		data["provisioning_state"] = r.ProvisioningState
+		data["send_invitation"] = r.SendInvitation
+		data["provider_name"] = r.ProviderName
+		data["provider_attribute_name"] = r.ProviderAttributeName
+		data["provider_subject_template"] = r.ProviderSubjectTemplate
+		data["max_active_users"] = r.MaxActiveUsers
+		data["max_users_per_month"] = r.MaxUsersPerMonth
+		data["deletion_policy"] = r.DeletionPolicy
 		data["ttl"] = r.TTL / time.Second
 		data["max_ttl"] = r.MaxTTL / time.Second
 	} else {
 		data["cognito_pool_domain"] = r.CognitoPoolDomain
+		data["app_client_id"] = r.AppClientId
 	}
 
 	return &logical.Response{
@@ -232,12 +585,43 @@ func (b *cognitoSecretBackend) pathRoleList(ctx context.Context, req *logical.Re
 func (b *cognitoSecretBackend) pathRoleDelete(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
 	name := d.Get("name").(string)
 
-	err := req.Storage.Delete(ctx, fmt.Sprintf("%s/%s", rolesStoragePath, name))
+	role, err := getRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading role: {{err}}", err)
+	}
+
+	var resp *logical.Response
+	if role != nil && role.CredentialType == credentialTypeUser {
+		users, err := roleUserEntries(ctx, req.Storage, name)
+		if err != nil {
+			return nil, err
+		}
+
+		switch role.DeletionPolicy {
+		case deletionPolicyRefuse:
+			if len(users) > 0 {
+				return logical.ErrorResponse(fmt.Sprintf("role '%s' has %d users with an active lease, revoke the leases before deleting the role", name, len(users))), nil
+			}
+		case deletionPolicyRevoke:
+			if err := b.deleteRoleUsers(ctx, req, users); err != nil {
+				return nil, err
+			}
+
+			// a plugin cannot revoke leases, so the leases of the deleted users
+			// remain until they expire, revoking them then succeeds
+			if len(users) > 0 {
+				resp = &logical.Response{}
+				resp.AddWarning(fmt.Sprintf("deleted %d users of role '%s', their leases remain until they expire, revoke them with: vault lease revoke -prefix %screds/%s", len(users), name, req.MountPoint, name))
+			}
+		}
+	}
+
+	err = req.Storage.Delete(ctx, fmt.Sprintf("%s/%s", rolesStoragePath, name))
 	if err != nil {
 		return nil, errwrap.Wrapf("error deleting role: {{err}}", err)
 	}
 
-	return nil, nil
+	return resp, nil
 }
 
 func (b *cognitoSecretBackend) pathRoleExistenceCheck(ctx context.Context, req *logical.Request, d *framework.FieldData) (bool, error) {
@@ -277,6 +661,216 @@ func getRole(ctx context.Context, name string, s logical.Storage) (*roleEntry, e
 	return role, nil
 }
 
+// deleteRoleUsers deletes the users of a role from their user pools and stops
+// tracking them, so that their leases can be revoked without the role. The role
+// should not be deleted if an error is returned, so that the delete can be retried.
+func (b *cognitoSecretBackend) deleteRoleUsers(ctx context.Context, req *logical.Request, users []*userEntry) error {
+	client, err := b.getClient(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	var merr *multierror.Error
+	for _, user := range users {
+		if err := client.deleteUser(ctx, user.Region, user.UserPoolId, user.Username); err != nil {
+			merr = multierror.Append(merr, errwrap.Wrapf(fmt.Sprintf("unable to delete user %s: {{err}}", user.Username), err))
+			continue
+		}
+
+		if err := deleteUserEntry(ctx, req.Storage, user.key()); err != nil {
+			merr = multierror.Append(merr, errwrap.Wrapf("error deleting user entry: {{err}}", err))
+			continue
+		}
+
+		if err := b.releaseUser(ctx, req.Storage, user.Role, true); err != nil {
+			merr = multierror.Append(merr, err)
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// stringMap returns m, or an empty map if m is nil
+func stringMap(m map[string]string) map[string]string {
+	if m == nil {
+		return map[string]string{}
+	}
+	return m
+}
+
+// stringSlice returns s, or an empty slice if s is nil
+func stringSlice(s []string) []string {
+	if s == nil {
+		return []string{}
+	}
+	return s
+}
+
+// userGroups returns the groups that users created by the role are added to
+func (r *roleEntry) userGroups() []string {
+	var groups []string
+	if r.Group != "" {
+		groups = append(groups, r.Group)
+	}
+	for _, group := range r.Groups {
+		if !strutil.StrListContains(groups, group) {
+			groups = append(groups, group)
+		}
+	}
+	return groups
+}
+
+// provisioningState returns the state to leave created users in. Roles stored
+// before provisioning states were added have none, and their users are confirmed.
+// setsEmail reports whether the role configures the email address of its users,
+// by setting a dummy email domain or its own email template
+func (r *roleEntry) setsEmail() bool {
+	return r.DummyEmailDomain != "" || (r.EmailTemplate != "" && r.EmailTemplate != defaultEmailTemplate)
+}
+
+// usesAppClient reports whether the role's app client signs in, or signs up,
+// the created users, which depends on the provisioning state
+func (r *roleEntry) usesAppClient() bool {
+	state := r.provisioningState()
+	return state == provisioningStateConfirmed || state == provisioningStateUnconfirmed
+}
+
+func (r *roleEntry) provisioningState() string {
+	if r.ProvisioningState == "" {
+		return provisioningStateConfirmed
+	}
+	return r.ProvisioningState
+}
+
+// requestableGroups returns the groups that can be chosen when requesting credentials
+func (r *roleEntry) requestableGroups() []string {
+	if len(r.AllowedGroups) > 0 {
+		return r.AllowedGroups
+	}
+	return r.userGroups()
+}
+
+// validateRole checks that the role has the fields that its credential type
+// requires, and that the fields set by the request apply to its type.
+func validateRole(role *roleEntry, d *framework.FieldData) error {
+	if !strutil.StrListContains(credentialTypes, role.CredentialType) {
+		return fmt.Errorf("unsupported credential_type '%s', must be one of %s", role.CredentialType, strings.Join(credentialTypes, ", "))
+	}
+
+	var merr *multierror.Error
+
+	otherFields := userRoleFields
+	if role.CredentialType == credentialTypeUser {
+		otherFields = clientCredentialsRoleFields
+	}
+
+	var notApplicable []string
+	for field := range d.Raw {
+		if strutil.StrListContains(otherFields, field) {
+			notApplicable = append(notApplicable, field)
+		}
+	}
+	if len(notApplicable) > 0 {
+		sort.Strings(notApplicable)
+		merr = multierror.Append(merr, fmt.Errorf("%s cannot be set for %s roles", strings.Join(notApplicable, ", "), role.CredentialType))
+	}
+
+	var required map[string]string
+	if role.CredentialType == credentialTypeUser {
+		required = map[string]string{
+			"region":       role.Region,
+			"user_pool_id": role.UserPoolId,
+		}
+		if role.usesAppClient() {
+			required["app_client_id"] = role.AppClientId
+		}
+	} else {
+		required = map[string]string{
+			"cognito_pool_domain": role.CognitoPoolDomain,
+			"app_client_id":       role.AppClientId,
+			"app_client_secret":   role.AppClientSecret,
+		}
+	}
+
+	var missing []string
+	for field, value := range required {
+		if value == "" {
+			missing = append(missing, field)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		merr = multierror.Append(merr, fmt.Errorf("%s must be set for %s roles", strings.Join(missing, ", "), role.CredentialType))
+	}
+
+	if role.CredentialType == credentialTypeUser && len(role.userGroups()) == 0 {
+		merr = multierror.Append(merr, fmt.Errorf("group or groups must be set for %s roles", role.CredentialType))
+	}
+
+	if role.CredentialType == credentialTypeUser && role.UserPoolId != "" {
+		// user pool ids are prefixed with their region, e.g. eu-west-1_aBcDeFgHi
+		parts := strings.SplitN(role.UserPoolId, "_", 2)
+		switch {
+		case len(parts) != 2 || parts[0] == "" || parts[1] == "":
+			merr = multierror.Append(merr, fmt.Errorf("invalid user_pool_id '%s', must be the region and id of the user pool, e.g. eu-west-1_aBcDeFgHi", role.UserPoolId))
+		case role.Region != "" && parts[0] != role.Region:
+			merr = multierror.Append(merr, fmt.Errorf("user_pool_id '%s' is not in region '%s'", role.UserPoolId, role.Region))
+		}
+	}
+
+	return merr.ErrorOrNil()
+}
+
+// validateRoleRemote checks that the user pool, app client and groups of a user
+// role exist, or that the token endpoint of a client credentials role issues a
+// token. Required attributes of the user pool that the role does not set are
+// returned as warnings, as they can still be set when requesting credentials.
+func (b *cognitoSecretBackend) validateRoleRemote(ctx context.Context, req *logical.Request, role *roleEntry) ([]string, error) {
+	client, err := b.getClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if role.CredentialType != credentialTypeUser {
+		return nil, checkTokenEndpointGrant(ctx, client, role)
+	}
+
+	userPool, err := client.describeUserPool(ctx, role.Region, role.UserPoolId)
+	if err != nil {
+		return nil, err
+	}
+
+	if role.AppClientId != "" {
+		if _, err := client.describeUserPoolClient(ctx, role.Region, role.UserPoolId, role.AppClientId); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, group := range strutil.RemoveDuplicates(append(role.userGroups(), role.AllowedGroups...), false) {
+		if err := client.getGroup(ctx, role.Region, role.UserPoolId, group); err != nil {
+			return nil, err
+		}
+	}
+
+	// the values do not matter, only which attributes the role sets
+	var phoneNumber string
+	if userPool.usesAttribute(attributePhoneNumber) {
+		phoneNumber = "+447700900000"
+	}
+	attributes := userPool.identityAttributes("vault", "vault@example.com", phoneNumber)
+	for name := range role.UserAttributes {
+		attributes[name] = name
+	}
+	for _, name := range role.MetadataAttributes {
+		attributes[name] = name
+	}
+
+	if err := userPool.checkRequiredAttributes(attributes); err != nil {
+		return []string{fmt.Sprintf("%s, creds requests must set them with attributes", err)}, nil
+	}
+	return nil, nil
+}
+
 const roleHelpSyn = "Manage the Vault roles used to generate cognito credentials."
 const roleHelpDesc = `
 This path allows you to read and write roles that are used to generate cognito login
@@ -2,9 +2,11 @@ package cognito
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/hashicorp/vault/sdk/logical"
 	"sort"
+	"strings"
 	"testing"
 	"time"
 )
@@ -16,12 +18,14 @@ func TestRoleCreate(t *testing.T) {
 		clientCredentialGrantRole1 := map[string]interface{}{
 			"credential_type":     "client_credentials_grant",
 			"cognito_pool_domain": "aa",
+			"app_client_id":       "aaa",
 			"app_client_secret":   "aaa",
 		}
 
 		clientCredentialGrantRole2 := map[string]interface{}{
 			"credential_type":     "client_credentials_grant",
 			"cognito_pool_domain": "bb",
+			"app_client_id":       "bbb",
 			"app_client_secret":   "bbb",
 		}
 
@@ -43,25 +47,70 @@ func TestRoleCreate(t *testing.T) {
 	})
 	t.Run("User role", func(t *testing.T) {
 		userRole1 := map[string]interface{}{
-			"credential_type":    "user",
-			"region":             "aa",
-			"app_client_id":      "aaa",
-			"user_pool_id":       "aaaa",
-			"group":              "aaaaa",
-			"dummy_email_domain": "aaaaaa",
-			"ttl":                int64(0),
-			"max_ttl":            int64(0),
+			"credential_type":            "user",
+			"region":                     "eu-west-1",
+			"app_client_id":              "aaa",
+			"user_pool_id":               "eu-west-1_aaaa",
+			"group":                      "aaaaa",
+			"groups":                     []string{},
+			"allowed_groups":             []string{},
+			"dummy_email_domain":         "aaaaaa",
+			"metadata_attributes":        map[string]string{},
+			"user_attributes":            map[string]string{},
+			"client_metadata":            map[string]string{},
+			"username_template":          defaultUsernameTemplate,
+			"email_template":             defaultEmailTemplate,
+			"phone_number_template":      defaultPhoneNumberTemplate,
+			"password_policy":            "",
+			"allowed_attributes":         []string{},
+			"max_username_suffix_length": 0,
+			"provisioning_state":         "confirmed",
+			"send_invitation":            false,
+			"provider_name":              "",
+			"provider_attribute_name":    defaultProviderAttributeName,
+			"provider_subject_template":  defaultProviderSubjectTemplate,
+			"max_active_users":           0,
+			"max_users_per_month":        0,
+			"deletion_policy":            "snapshot",
+			"ttl":                        int64(0),
+			"max_ttl":                    int64(0),
 		}
 
 		userRole2 := map[string]interface{}{
 			"credential_type":    "user",
-			"region":             "bb",
+			"region":             "eu-west-2",
 			"app_client_id":      "bbb",
-			"user_pool_id":       "bbbb",
+			"user_pool_id":       "eu-west-2_bbbb",
 			"group":              "bbbbb",
+			"groups":             []string{"tenant-a", "approver"},
+			"allowed_groups":     []string{"tenant-a", "tenant-b", "approver"},
 			"dummy_email_domain": "bbbbbb",
-			"ttl":                int64(300),
-			"max_ttl":            int64(3000),
+			"metadata_attributes": map[string]string{
+				"role":       "custom:vault_role",
+				"expires_at": "custom:vault_expires_at",
+			},
+			"user_attributes": map[string]string{
+				"custom:tenant_id": `{{index .Entity.Metadata "tenant_id"}}`,
+			},
+			"client_metadata": map[string]string{
+				"vault_role": `{{.RoleName}}`,
+			},
+			"username_template":          `{{.DisplayName}}-{{random 8}}`,
+			"email_template":             `{{.RoleName}}@example.com`,
+			"phone_number_template":      `+1555{{random_digits 7}}`,
+			"password_policy":            "cognito",
+			"allowed_attributes":         []string{"custom:plan", "locale"},
+			"max_username_suffix_length": 10,
+			"provisioning_state":         "reset_required",
+			"send_invitation":            true,
+			"provider_name":              "CorporateSAML",
+			"provider_attribute_name":    "NameID",
+			"provider_subject_template":  `{{.Username}}`,
+			"max_active_users":           20,
+			"max_users_per_month":        500,
+			"deletion_policy":            "refuse",
+			"ttl":                        int64(300),
+			"max_ttl":                    int64(3000),
 		}
 
 		// Verify basic updates of the name role
@@ -85,9 +134,9 @@ func TestRoleCreate(t *testing.T) {
 	t.Run("User Optional role TTLs", func(t *testing.T) {
 		testRole := map[string]interface{}{
 			"credential_type":    "user",
-			"region":             "cc",
+			"region":             "eu-west-3",
 			"app_client_id":      "ccc",
-			"user_pool_id":       "cccc",
+			"user_pool_id":       "eu-west-3_cccc",
 			"group":              "ccccc",
 			"dummy_email_domain": "cccccc",
 		}
@@ -96,6 +145,25 @@ func TestRoleCreate(t *testing.T) {
 		name := generateUUID()
 		testRoleCreate(t, b, s, name, testRole)
 
+		testRole["groups"] = []string{}
+		testRole["allowed_groups"] = []string{}
+		testRole["metadata_attributes"] = map[string]string{}
+		testRole["user_attributes"] = map[string]string{}
+		testRole["client_metadata"] = map[string]string{}
+		testRole["username_template"] = defaultUsernameTemplate
+		testRole["email_template"] = defaultEmailTemplate
+		testRole["phone_number_template"] = defaultPhoneNumberTemplate
+		testRole["password_policy"] = ""
+		testRole["allowed_attributes"] = []string{}
+		testRole["max_username_suffix_length"] = 0
+		testRole["provisioning_state"] = "confirmed"
+		testRole["send_invitation"] = false
+		testRole["provider_name"] = ""
+		testRole["provider_attribute_name"] = defaultProviderAttributeName
+		testRole["provider_subject_template"] = defaultProviderSubjectTemplate
+		testRole["max_active_users"] = 0
+		testRole["max_users_per_month"] = 0
+		testRole["deletion_policy"] = "snapshot"
 		testRole["ttl"] = int64(0)
 		testRole["max_ttl"] = int64(0)
 
@@ -126,9 +194,9 @@ func TestRoleCreate(t *testing.T) {
 		for i, test := range tests {
 			role := map[string]interface{}{
 				"credential_type":    "user",
-				"region":             "cc",
+				"region":             "eu-west-3",
 				"app_client_id":      "ccc",
-				"user_pool_id":       "cccc",
+				"user_pool_id":       "eu-west-3_cccc",
 				"group":              "ccccc",
 				"dummy_email_domain": "cccccc",
 			}
@@ -155,6 +223,338 @@ func TestRoleCreate(t *testing.T) {
 	})
 }
 
+func TestRoleMetadataAttributes(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.CreateOperation,
+		Path:      "roles/test_role",
+		Data: map[string]interface{}{
+			"credential_type": "user",
+			"region":          "eu-west-1",
+			"user_pool_id":    "eu-west-1_aaaa",
+			"group":           "testGroup",
+			"app_client_id":   "testAppClientId",
+			"metadata_attributes": map[string]interface{}{
+				"not_a_key": "custom:vault_not_a_key",
+			},
+		},
+		Storage: s,
+	})
+	assertErrorIsNil(t, err)
+
+	if !resp.IsError() {
+		t.Fatal("expected an error for an unsupported metadata key")
+	}
+}
+
+func TestRoleValidation(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	tests := map[string]map[string]interface{}{
+		"invalid template": {
+			"user_attributes": map[string]interface{}{
+				"custom:tenant_id": "{{.RoleName",
+			},
+		},
+		"invalid client metadata template": {
+			"client_metadata": map[string]interface{}{
+				"vault_role": "{{.RoleName",
+			},
+		},
+		"invalid provider subject template": {
+			"provider_name":             "CorporateSAML",
+			"provider_subject_template": "{{.Username",
+		},
+		"negative max active users": {
+			"max_active_users": -1,
+		},
+		"negative max users per month": {
+			"max_users_per_month": -1,
+		},
+		"unsupported deletion policy": {
+			"deletion_policy": "ignore",
+		},
+		"native provider": {
+			"provider_name": "Cognito",
+		},
+		"unsupported provisioning state": {
+			"provisioning_state": "disabled",
+		},
+		"invalid username template": {
+			"username_template": "{{.DisplayName",
+		},
+		"invalid phone number template": {
+			"phone_number_template": "{{random_digits",
+		},
+		"invalid email template": {
+			"email_template": "{{.RoleName",
+		},
+		"attribute also used for metadata": {
+			"metadata_attributes": map[string]interface{}{
+				"role": "custom:vault_role",
+			},
+			"user_attributes": map[string]interface{}{
+				"custom:vault_role": "{{.RoleName}}",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test["credential_type"] = "user"
+			test["region"] = "eu-west-1"
+			test["user_pool_id"] = "eu-west-1_aaaa"
+			test["app_client_id"] = "testAppClientId"
+			test["group"] = "testGroup"
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.CreateOperation,
+				Path:      "roles/test_role",
+				Data:      test,
+				Storage:   s,
+			})
+			assertErrorIsNil(t, err)
+
+			if !resp.IsError() {
+				t.Fatal("expected an error response")
+			}
+		})
+	}
+}
+
+func TestRoleCredentialTypeValidation(t *testing.T) {
+	b, s := getTestBackend(t, true)
+
+	tests := map[string]struct {
+		role   map[string]interface{}
+		expErr string
+	}{
+		"unsupported credential type": {
+			role: map[string]interface{}{
+				"credential_type": "password",
+			},
+			expErr: "unsupported credential_type 'password'",
+		},
+		"user role missing fields": {
+			role: map[string]interface{}{
+				"credential_type": "user",
+			},
+			expErr: "app_client_id, region, user_pool_id must be set for user roles",
+		},
+		"user role without sign in": {
+			role: map[string]interface{}{
+				"credential_type":    "user",
+				"region":             "eu-west-1",
+				"user_pool_id":       "eu-west-1_aaaa",
+				"group":              "testGroup",
+				"provisioning_state": "reset_required",
+			},
+		},
+		"user role with client credentials fields": {
+			role: map[string]interface{}{
+				"credential_type":     "user",
+				"region":              "eu-west-1",
+				"user_pool_id":        "eu-west-1_aaaa",
+				"app_client_id":       "testAppClientId",
+				"cognito_pool_domain": "aa",
+			},
+			expErr: "cognito_pool_domain cannot be set for user roles",
+		},
+		"user pool in another region": {
+			role: map[string]interface{}{
+				"credential_type": "user",
+				"region":          "eu-west-1",
+				"user_pool_id":    "us-east-1_aaaa",
+				"app_client_id":   "testAppClientId",
+			},
+			expErr: "user_pool_id 'us-east-1_aaaa' is not in region 'eu-west-1'",
+		},
+		"user pool without region": {
+			role: map[string]interface{}{
+				"credential_type": "user",
+				"region":          "eu-west-1",
+				"user_pool_id":    "aaaa",
+				"app_client_id":   "testAppClientId",
+			},
+			expErr: "invalid user_pool_id 'aaaa'",
+		},
+		"user role without groups": {
+			role: map[string]interface{}{
+				"credential_type": "user",
+				"region":          "eu-west-1",
+				"user_pool_id":    "eu-west-1_aaaa",
+				"app_client_id":   "testAppClientId",
+			},
+			expErr: "group or groups must be set for user roles",
+		},
+		"user role with groups": {
+			role: map[string]interface{}{
+				"credential_type": "user",
+				"region":          "eu-west-1",
+				"user_pool_id":    "eu-west-1_aaaa",
+				"app_client_id":   "testAppClientId",
+				"groups":          "tenant-a,approver",
+			},
+		},
+		"client credentials role missing fields": {
+			role: map[string]interface{}{
+				"credential_type": "client_credentials_grant",
+			},
+			expErr: "app_client_id, app_client_secret, cognito_pool_domain must be set for client_credentials_grant roles",
+		},
+		"client credentials role with user fields": {
+			role: map[string]interface{}{
+				"credential_type":     "client_credentials_grant",
+				"cognito_pool_domain": "aa",
+				"app_client_id":       "aaa",
+				"app_client_secret":   "aaa",
+				"user_pool_id":        "eu-west-1_aaaa",
+				"group":               "admins",
+			},
+			expErr: "group, user_pool_id cannot be set for client_credentials_grant roles",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.CreateOperation,
+				Path:      "roles/" + generateUUID(),
+				Data:      test.role,
+				Storage:   s,
+			})
+			assertErrorIsNil(t, err)
+
+			if test.expErr == "" {
+				if resp.IsError() {
+					t.Fatalf("expected no error, actual: %v", resp.Error())
+				}
+				return
+			}
+			if !resp.IsError() {
+				t.Fatal("expected an error response")
+			}
+			if !strings.Contains(resp.Error().Error(), test.expErr) {
+				t.Fatalf("expected error containing %q, actual: %v", test.expErr, resp.Error())
+			}
+		})
+	}
+
+	t.Run("role stored without provisioning state", func(t *testing.T) {
+		// roles stored before provisioning states were added sign their users in
+		name := generateUUID()
+		err := saveRole(context.Background(), s, &roleEntry{
+			CredentialType: credentialTypeUser,
+			Region:         "eu-west-1",
+			UserPoolId:     "eu-west-1_aaaa",
+			Group:          "testGroup",
+		}, name)
+		assertErrorIsNil(t, err)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.UpdateOperation,
+			Path:      "roles/" + name,
+			Data: map[string]interface{}{
+				"ttl": 60,
+			},
+			Storage: s,
+		})
+		assertErrorIsNil(t, err)
+
+		if !resp.IsError() || !strings.Contains(resp.Error().Error(), "app_client_id must be set for user roles") {
+			t.Fatalf("expected app_client_id to be required, actual: %#v", resp)
+		}
+	})
+}
+
+func TestRoleValidateRemote(t *testing.T) {
+	role := func() map[string]interface{} {
+		return map[string]interface{}{
+			"credential_type": "user",
+			"region":          "eu-west-1",
+			"user_pool_id":    "eu-west-1_aaaa",
+			"app_client_id":   "testAppClientId",
+			"group":           "admins",
+			"allowed_groups":  []string{"tenant-a"},
+			"validate_remote": true,
+		}
+	}
+
+	write := func(b *cognitoSecretBackend, s logical.Storage, data map[string]interface{}) *logical.Response {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.CreateOperation,
+			Path:      "roles/test_role",
+			Data:      data,
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		return resp
+	}
+
+	t.Run("Valid role", func(t *testing.T) {
+		b, s := getTestBackend(t, true)
+		b.client.(*mockClient).groups = []string{"admins", "tenant-a"}
+
+		resp := write(b, s, role())
+		if resp != nil && (resp.IsError() || len(resp.Warnings) > 0) {
+			t.Fatalf("expected no error or warnings, actual: %#v", resp)
+		}
+	})
+
+	t.Run("Missing group", func(t *testing.T) {
+		b, s := getTestBackend(t, true)
+		b.client.(*mockClient).groups = []string{"admins"}
+
+		resp := write(b, s, role())
+		if !resp.IsError() {
+			t.Fatal("expected an error response")
+		}
+		if !strings.Contains(resp.Error().Error(), "tenant-a") {
+			t.Fatalf("expected the missing group in the error, actual: %v", resp.Error())
+		}
+
+		resp, err := testRoleRead(t, b, s, "test_role")
+		assertErrorIsNil(t, err)
+		if resp != nil {
+			t.Fatal("expected the role not to be stored")
+		}
+	})
+
+	t.Run("Required attributes", func(t *testing.T) {
+		b, s := getTestBackend(t, true)
+		b.client.(*mockClient).userPool = &userPoolDetails{RequiredAttributes: []string{"email", "given_name", "family_name"}}
+
+		data := role()
+		data["user_attributes"] = map[string]interface{}{
+			"family_name": "Vault",
+		}
+		resp := write(b, s, data)
+		if resp == nil || resp.IsError() {
+			t.Fatalf("expected a warning response, actual: %#v", resp)
+		}
+		if len(resp.Warnings) != 1 || !strings.Contains(resp.Warnings[0], "given_name") || strings.Contains(resp.Warnings[0], "family_name") {
+			t.Fatalf("expected a warning for given_name, actual: %v", resp.Warnings)
+		}
+	})
+
+	t.Run("Client credentials role", func(t *testing.T) {
+		b, s := getTestBackend(t, true)
+		b.client.(*mockClient).clientCredentialsErr = errors.New("invalid_client")
+
+		resp := write(b, s, map[string]interface{}{
+			"credential_type":     "client_credentials_grant",
+			"cognito_pool_domain": "aa",
+			"app_client_id":       "aaa",
+			"app_client_secret":   "aaa",
+			"validate_remote":     true,
+		})
+		if !resp.IsError() {
+			t.Fatal("expected an error response")
+		}
+	})
+}
+
 func TestRoleList(t *testing.T) {
 	b, s := getTestBackend(t, true)
 
@@ -174,7 +574,10 @@ func TestRoleList(t *testing.T) {
 
 	// Add some roles and verify the resulting list
 	role := map[string]interface{}{
+		"credential_type":     "client_credentials_grant",
 		"cognito_pool_domain": "aa",
+		"app_client_id":       "aaa",
+		"app_client_secret":   "aaa",
 	}
 	testRoleCreate(t, b, s, "r1", role)
 	testRoleCreate(t, b, s, "r2", role)
@@ -217,7 +620,10 @@ func TestRoleDelete(t *testing.T) {
 	nameAlt := "test_role_alt"
 
 	role := map[string]interface{}{
+		"credential_type":     "client_credentials_grant",
 		"cognito_pool_domain": "aa",
+		"app_client_id":       "aaa",
+		"app_client_secret":   "aaa",
 	}
 
 	// Create two roles and verify they're present
@@ -254,6 +660,143 @@ func TestRoleDelete(t *testing.T) {
 	}
 }
 
+func TestRoleDeletionPolicy(t *testing.T) {
+	setup := func(t *testing.T, deletionPolicy string) (*cognitoSecretBackend, logical.Storage, *logical.Secret) {
+		b, s := getTestBackend(t, true)
+		testRoleCreate(t, b, s, "test_role", map[string]interface{}{
+			"credential_type": "user",
+			"app_client_id":   "testAppClientId",
+			"region":          "eu-west-1",
+			"user_pool_id":    "eu-west-1_aaaa",
+			"group":           "testGroup",
+			"deletion_policy": deletionPolicy,
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/test_role",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		fakeSaveLoad(resp.Secret)
+
+		return b, s, resp.Secret
+	}
+
+	deleteRole := func(b *cognitoSecretBackend, s logical.Storage) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.DeleteOperation,
+			Path:      "roles/test_role",
+			Storage:   s,
+		})
+	}
+
+	revoke := func(t *testing.T, b *cognitoSecretBackend, s logical.Storage, secret *logical.Secret) {
+		t.Helper()
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    secret,
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+	}
+
+	t.Run("Snapshot", func(t *testing.T) {
+		b, s, secret := setup(t, "snapshot")
+		mc := b.client.(*mockClient)
+
+		resp, err := deleteRole(b, s)
+		assertErrorIsNil(t, err)
+		if resp != nil {
+			t.Fatalf("expected nil response, actual:%#v", resp)
+		}
+		equal(t, 0, len(mc.deletedUsers))
+
+		// the lease records the user pool, so the user can be revoked without the role
+		revoke(t, b, s, secret)
+		equal(t, []string{secret.InternalData["username"].(string)}, mc.deletedUsers)
+	})
+
+	t.Run("Snapshot without user pool in lease", func(t *testing.T) {
+		b, s, secret := setup(t, "snapshot")
+		mc := b.client.(*mockClient)
+		delete(secret.InternalData, "region")
+		delete(secret.InternalData, "user_pool_id")
+
+		_, err := deleteRole(b, s)
+		assertErrorIsNil(t, err)
+
+		// leases issued before the user pool was recorded use the user entry
+		revoke(t, b, s, secret)
+		equal(t, []string{secret.InternalData["username"].(string)}, mc.deletedUsers)
+
+		// and revocation fails once nothing is known about the user, rather than
+		// leave the user in the user pool
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret:    secret,
+			Storage:   s,
+		})
+		if err == nil || !strings.Contains(err.Error(), "unable to find the user pool") {
+			t.Fatalf("expected an error, actual: %v", err)
+		}
+		equal(t, 1, len(mc.deletedUsers))
+	})
+
+	t.Run("Refuse", func(t *testing.T) {
+		b, s, secret := setup(t, "refuse")
+
+		resp, err := deleteRole(b, s)
+		assertErrorIsNil(t, err)
+		if !resp.IsError() {
+			t.Fatal("expected an error deleting a role with active users")
+		}
+
+		revoke(t, b, s, secret)
+
+		resp, err = deleteRole(b, s)
+		assertErrorIsNil(t, err)
+		if resp != nil {
+			t.Fatalf("expected nil response, actual:%#v", resp)
+		}
+
+		resp, err = testRoleRead(t, b, s, "test_role")
+		assertErrorIsNil(t, err)
+		if resp != nil {
+			t.Fatalf("expected the role to be deleted, actual:%#v", resp)
+		}
+	})
+
+	t.Run("Revoke", func(t *testing.T) {
+		b, s, secret := setup(t, "revoke")
+		mc := b.client.(*mockClient)
+		username := secret.InternalData["username"].(string)
+
+		resp, err := deleteRole(b, s)
+		assertErrorIsNil(t, err)
+		if resp.IsError() {
+			t.Fatalf("expected no response error, actual:%#v", resp.Error())
+		}
+		equal(t, []string{username}, mc.deletedUsers)
+
+		// the leases are not revoked, the warning says how to revoke them
+		equal(t, []string{"deleted 1 users of role 'test_role', their leases remain until they expire, revoke them with: vault lease revoke -prefix creds/test_role"}, resp.Warnings)
+
+		entry, err := getUserEntry(context.Background(), s, userKey("eu-west-1", "eu-west-1_aaaa", username))
+		assertErrorIsNil(t, err)
+		if entry != nil {
+			t.Fatalf("expected user entry to be deleted, actual: %#v", entry)
+		}
+
+		usage, err := getRoleUsage(context.Background(), s, "test_role", time.Now())
+		assertErrorIsNil(t, err)
+		equal(t, 0, usage.ActiveUsers)
+
+		// the lease can still be revoked once the user has been deleted
+		revoke(t, b, s, secret)
+	})
+}
+
 // Utility function to create a role and fail on errors
 func testRoleCreate(t *testing.T, b *cognitoSecretBackend, s logical.Storage, name string, d map[string]interface{}) {
 	t.Helper()
@@ -0,0 +1,333 @@
+package cognito
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+	"golang.org/x/time/rate"
+)
+
+const (
+	defaultTidySafetyBuffer = time.Hour
+	defaultTidyRateLimit    = 5
+)
+
+// tidyResult reports the outcome of a tidy operation
+type tidyResult struct {
+	OrphanedUsers []map[string]interface{}
+	Deleted       int
+	Warnings      []string
+}
+
+func pathTidy(b *cognitoSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "tidy",
+		Fields: map[string]*framework.FieldSchema{
+			"dry_run": {
+				Type:        framework.TypeBool,
+				Description: "Report orphaned users without deleting them.",
+				Default:     false,
+			},
+			"safety_buffer": {
+				Type:        framework.TypeDurationSecond,
+				Description: "The minimum age of an untracked user before it is considered an orphan, defaults to 1 hour.",
+				Default:     int(defaultTidySafetyBuffer / time.Second),
+			},
+			"rate_limit": {
+				Type:        framework.TypeInt,
+				Description: "The maximum number of users to delete per second.",
+				Default:     defaultTidyRateLimit,
+			},
+		},
+		Operations: map[logical.Operation]framework.OperationHandler{
+			logical.UpdateOperation: &framework.PathOperation{
+				Callback:                    b.pathTidyWrite,
+				ForwardPerformanceSecondary: true,
+				ForwardPerformanceStandby:   true,
+			},
+		},
+
+		HelpSynopsis:    pathTidyHelpSyn,
+		HelpDescription: pathTidyHelpDesc,
+	}
+}
+
+func (b *cognitoSecretBackend) pathTidyWrite(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	dryRun := d.Get("dry_run").(bool)
+	safetyBuffer := time.Duration(d.Get("safety_buffer").(int)) * time.Second
+	rateLimit := d.Get("rate_limit").(int)
+
+	if safetyBuffer < 0 {
+		return logical.ErrorResponse("safety_buffer cannot be negative"), nil
+	}
+
+	if rateLimit <= 0 {
+		return logical.ErrorResponse("rate_limit must be greater than 0"), nil
+	}
+
+	result, err := b.tidyUsers(ctx, req, dryRun, safetyBuffer, rateLimit)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := &logical.Response{
+		Data: map[string]interface{}{
+			"dry_run":        dryRun,
+			"orphaned_users": result.OrphanedUsers,
+			"deleted":        result.Deleted,
+		},
+	}
+	for _, w := range result.Warnings {
+		resp.AddWarning(w)
+	}
+
+	return resp, nil
+}
+
+// tidyPeriodic runs tidy when automatic tidy is enabled in the config and the
+// tidy interval has passed since the last run.
+func (b *cognitoSecretBackend) tidyPeriodic(ctx context.Context, req *logical.Request) error {
+	config, err := b.getConfig(ctx, req.Storage)
+	if err != nil {
+		return err
+	}
+
+	if config == nil || config.TidyInterval == 0 {
+		return nil
+	}
+
+	b.tidyLock.Lock()
+	if time.Since(b.lastTidy) < config.TidyInterval {
+		b.tidyLock.Unlock()
+		return nil
+	}
+	b.lastTidy = time.Now()
+	b.tidyLock.Unlock()
+
+	safetyBuffer := config.TidySafetyBuffer
+	if safetyBuffer == 0 {
+		safetyBuffer = defaultTidySafetyBuffer
+	}
+
+	result, err := b.tidyUsers(ctx, req, false, safetyBuffer, defaultTidyRateLimit)
+	if err != nil {
+		return err
+	}
+
+	b.Logger().Info("tidy completed", "orphaned", len(result.OrphanedUsers), "deleted", result.Deleted)
+	for _, w := range result.Warnings {
+		b.Logger().Warn(w)
+	}
+
+	return nil
+}
+
+// tidyUsers finds users in the user pools of all user roles that carry the role
+// metadata attribute of one of the roles, but are not tracked as having an
+// active lease, and deletes them unless dryRun is set. Users without the marker
+// attribute are never considered, whatever their email address, as they may have
+// been created before users were tracked or by something other than Vault.
+func (b *cognitoSecretBackend) tidyUsers(ctx context.Context, req *logical.Request, dryRun bool, safetyBuffer time.Duration, rateLimit int) (*tidyResult, error) {
+	if !atomic.CompareAndSwapUint32(&b.tidyRunning, 0, 1) {
+		return nil, fmt.Errorf("tidy operation already in progress")
+	}
+	defer atomic.StoreUint32(&b.tidyRunning, 0)
+
+	keys, err := listUserEntries(ctx, req.Storage)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing users: {{err}}", err)
+	}
+
+	tracked := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		tracked[key] = true
+	}
+
+	result := &tidyResult{
+		OrphanedUsers: []map[string]interface{}{},
+	}
+
+	pools, warnings, err := tidyPools(ctx, req.Storage)
+	if err != nil {
+		return nil, err
+	}
+	result.Warnings = append(result.Warnings, warnings...)
+
+	if len(pools) == 0 {
+		return result, nil
+	}
+
+	client, err := b.getClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	limiter := rate.NewLimiter(rate.Limit(rateLimit), 1)
+	cutoff := time.Now().Add(-safetyBuffer)
+
+	for _, pool := range pools {
+		users, err := client.listUsers(ctx, pool.Region, pool.UserPoolId)
+		if err != nil {
+			result.Warnings = append(result.Warnings, fmt.Sprintf("unable to list users in user pool %s: %s", pool.UserPoolId, err))
+			continue
+		}
+
+		isTracked := func(username string) bool {
+			return username != "" && tracked[userKey(pool.Region, pool.UserPoolId, username)]
+		}
+
+		for _, user := range users {
+			// users in pools with email or phone number usernames are listed by
+			// their sub, but were created with the email or phone number
+			if isTracked(user.Username) || isTracked(user.Email) || isTracked(user.PhoneNumber) || user.CreateDate.After(cutoff) {
+				continue
+			}
+
+			marker := pool.marker(user, req.MountPoint)
+			if marker == nil {
+				continue
+			}
+
+			result.OrphanedUsers = append(result.OrphanedUsers, map[string]interface{}{
+				"username":     user.Username,
+				"email":        user.Email,
+				"role":         marker.RoleName,
+				"region":       pool.Region,
+				"user_pool_id": pool.UserPoolId,
+				"status":       user.Status,
+				"create_date":  user.CreateDate.Format(time.RFC3339),
+			})
+
+			if dryRun {
+				continue
+			}
+
+			if err := limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+
+			if err := client.deleteUser(ctx, pool.Region, pool.UserPoolId, user.Username); err != nil {
+				result.Warnings = append(result.Warnings, fmt.Sprintf("unable to delete user %s: %s", user.Username, err))
+				continue
+			}
+			result.Deleted++
+		}
+	}
+
+	return result, nil
+}
+
+// userPool identifies a Cognito user pool
+type userPool struct {
+	Region     string
+	UserPoolId string
+}
+
+// tidyMarker identifies the users created for a role by the metadata attributes
+// that the role records on them
+type tidyMarker struct {
+	RoleName string
+	// RoleAttribute is the attribute that holds the name of the role
+	RoleAttribute string
+	// MountAttribute is the attribute that holds the mount path
+	MountAttribute string
+}
+
+// tidyPool is a user pool to tidy, with the markers of the roles that use it
+type tidyPool struct {
+	userPool
+	Markers []tidyMarker
+}
+
+// marker returns the marker of the role that created the user from this mount,
+// or nil if the user does not carry a marker.
+func (p *tidyPool) marker(user *poolUser, mountPoint string) *tidyMarker {
+	if mountPoint == "" {
+		return nil
+	}
+
+	for i, marker := range p.Markers {
+		if user.Attributes[marker.RoleAttribute] != marker.RoleName {
+			continue
+		}
+		if user.Attributes[marker.MountAttribute] != mountPoint {
+			continue
+		}
+		return &p.Markers[i]
+	}
+	return nil
+}
+
+// tidyPools returns the distinct user pools referenced by user roles that record
+// the role and mount metadata attributes, along with warnings for the user roles
+// that do not, as their users cannot be told apart from users created outside
+// Vault or by another mount with a role of the same name.
+func tidyPools(ctx context.Context, s logical.Storage) ([]*tidyPool, []string, error) {
+	names, err := s.List(ctx, rolesStoragePath+"/")
+	if err != nil {
+		return nil, nil, errwrap.Wrapf("error listing roles: {{err}}", err)
+	}
+
+	pools := make(map[userPool]*tidyPool)
+	var ordered []*tidyPool
+	var warnings []string
+	for _, name := range names {
+		role, err := getRole(ctx, name, s)
+		if err != nil {
+			return nil, nil, errwrap.Wrapf("error reading role: {{err}}", err)
+		}
+
+		if role == nil || role.CredentialType != credentialTypeUser || role.UserPoolId == "" {
+			continue
+		}
+
+		roleAttribute := role.MetadataAttributes[metadataRole]
+		mountAttribute := role.MetadataAttributes[metadataMount]
+		if roleAttribute == "" || mountAttribute == "" {
+			warnings = append(warnings, fmt.Sprintf("role %s does not set the %s and %s metadata attributes, its users are not tidied", name, metadataRole, metadataMount))
+			continue
+		}
+
+		key := userPool{Region: role.Region, UserPoolId: role.UserPoolId}
+		pool, ok := pools[key]
+		if !ok {
+			pool = &tidyPool{userPool: key}
+			pools[key] = pool
+			ordered = append(ordered, pool)
+		}
+		pool.Markers = append(pool.Markers, tidyMarker{
+			RoleName:       name,
+			RoleAttribute:  roleAttribute,
+			MountAttribute: mountAttribute,
+		})
+	}
+
+	return ordered, warnings, nil
+}
+
+const pathTidyHelpSyn = `
+Delete users created by Vault that no longer have an active lease.
+`
+
+const pathTidyHelpDesc = `
+This path lists the users in the user pools of all user roles, and deletes
+users created by Vault that are not tracked as having an active lease. This
+includes users whose revocation failed and users left behind by failed
+credential requests.
+
+A user is only considered to be created by Vault if its role metadata
+attribute, set with the metadata_attributes of the role, names a role that
+uses the user pool, and its mount metadata attribute names this mount. Users
+without the marker, such as users created before the role recorded it, by
+another mount or by something other than Vault, are never deleted. Roles that
+do not record both the role and mount metadata attributes are not tidied.
+
+Users younger than the safety buffer are ignored so that users being created
+at the time of the tidy are not deleted. Set dry_run to report the orphaned
+users without deleting them.
+`
@@ -0,0 +1,223 @@
+package cognito
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestTidy(t *testing.T) {
+	userRole := map[string]interface{}{
+		"credential_type": "user",
+		"app_client_id":   "testAppClientId",
+		"region":          "eu-west-1",
+		"user_pool_id":    "eu-west-1_aaaaaaaaa",
+		"group":           "testGroup",
+		"metadata_attributes": map[string]interface{}{
+			"role":  "custom:vault_role",
+			"mount": "custom:vault_mount",
+		},
+	}
+	marker := map[string]string{"custom:vault_role": "test_role", "custom:vault_mount": "cognito/"}
+
+	setup := func(t *testing.T) (*cognitoSecretBackend, logical.Storage, *mockClient) {
+		b, s := getTestBackend(t, true)
+		testRoleCreate(t, b, s, "test_role", userRole)
+
+		// issue a credential so that its user is tracked
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/test_role",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		if resp.IsError() {
+			t.Fatalf("expected no response error, actual:%#v", resp.Error())
+		}
+
+		mc := b.client.(*mockClient)
+		mc.poolUsers = []*poolUser{
+			{Username: resp.Data["username"].(string), CreateDate: time.Now().Add(-2 * time.Hour), Attributes: marker},
+			// users in email username pools are listed by their sub
+			{Username: "0b5e3e2c-sub", Email: resp.Data["username"].(string), CreateDate: time.Now().Add(-2 * time.Hour), Attributes: marker},
+			{Username: "vault-orphan@example.com", CreateDate: time.Now().Add(-2 * time.Hour), Attributes: marker},
+			{Username: "vault-new@example.com", CreateDate: time.Now(), Attributes: marker},
+			// users issued before users were tracked, and users not created by
+			// Vault, do not carry the marker
+			{Username: "vault-legacy@example.com", Email: "vault-legacy@example.com", CreateDate: time.Now().Add(-2 * time.Hour)},
+			{Username: "vaultadmin@corp", Email: "vaultadmin@corp", CreateDate: time.Now().Add(-2 * time.Hour)},
+			{Username: "vault-other-role@example.com", CreateDate: time.Now().Add(-2 * time.Hour), Attributes: map[string]string{"custom:vault_role": "other_role", "custom:vault_mount": "cognito/"}},
+		}
+		return b, s, mc
+	}
+
+	t.Run("Dry run", func(t *testing.T) {
+		b, s, mc := setup(t)
+
+		resp := testTidy(t, b, s, map[string]interface{}{
+			"dry_run": true,
+		})
+
+		orphans := resp.Data["orphaned_users"].([]map[string]interface{})
+		if len(orphans) != 1 {
+			t.Fatalf("expected 1 orphaned user, actual: %#v", orphans)
+		}
+		equal(t, "vault-orphan@example.com", orphans[0]["username"])
+		equal(t, 0, resp.Data["deleted"])
+		equal(t, 0, len(mc.deletedUsers))
+	})
+
+	t.Run("Delete orphans", func(t *testing.T) {
+		b, s, mc := setup(t)
+
+		resp := testTidy(t, b, s, map[string]interface{}{})
+
+		equal(t, 1, resp.Data["deleted"])
+		equal(t, []string{"vault-orphan@example.com"}, mc.deletedUsers)
+	})
+
+	t.Run("Safety buffer", func(t *testing.T) {
+		b, s, mc := setup(t)
+
+		resp := testTidy(t, b, s, map[string]interface{}{
+			"safety_buffer": 0,
+		})
+
+		equal(t, 2, resp.Data["deleted"])
+		equal(t, []string{"vault-orphan@example.com", "vault-new@example.com"}, mc.deletedUsers)
+	})
+
+	t.Run("Unmarked users are not deleted", func(t *testing.T) {
+		b, s, mc := setup(t)
+
+		resp := testTidy(t, b, s, map[string]interface{}{
+			"safety_buffer": 0,
+		})
+
+		for _, username := range mc.deletedUsers {
+			switch username {
+			case "vault-legacy@example.com", "vaultadmin@corp", "vault-other-role@example.com":
+				t.Fatalf("expected %s not to be deleted", username)
+			}
+		}
+		equal(t, 2, resp.Data["deleted"])
+	})
+
+	t.Run("Mount marker", func(t *testing.T) {
+		b, s, mc := setup(t)
+		role := map[string]interface{}{}
+		for k, v := range userRole {
+			role[k] = v
+		}
+		role["metadata_attributes"] = map[string]interface{}{
+			"role":  "custom:vault_role",
+			"mount": "custom:vault_mount",
+		}
+		testRoleCreate(t, b, s, "test_role", role)
+
+		mc.poolUsers = []*poolUser{
+			{Username: "vault-this-mount@example.com", CreateDate: time.Now().Add(-2 * time.Hour), Attributes: map[string]string{"custom:vault_role": "test_role", "custom:vault_mount": "cognito/"}},
+			{Username: "vault-other-mount@example.com", CreateDate: time.Now().Add(-2 * time.Hour), Attributes: map[string]string{"custom:vault_role": "test_role", "custom:vault_mount": "cognito-other/"}},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation:  logical.UpdateOperation,
+			Path:       "tidy",
+			MountPoint: "cognito/",
+			Storage:    s,
+		})
+		assertErrorIsNil(t, err)
+
+		equal(t, 1, resp.Data["deleted"])
+		equal(t, []string{"vault-this-mount@example.com"}, mc.deletedUsers)
+	})
+
+	t.Run("Roles without the mount marker are not tidied", func(t *testing.T) {
+		b, s, mc := setup(t)
+		role := map[string]interface{}{}
+		for k, v := range userRole {
+			role[k] = v
+		}
+		role["metadata_attributes"] = map[string]interface{}{
+			"role": "custom:vault_role",
+		}
+		testRoleCreate(t, b, s, "test_role", role)
+
+		// another mount's users on the same pool, under a role of the same name
+		mc.poolUsers = []*poolUser{
+			{Username: "vault-other-mount@example.com", CreateDate: time.Now().Add(-2 * time.Hour), Attributes: map[string]string{"custom:vault_role": "test_role"}},
+		}
+
+		resp := testTidy(t, b, s, map[string]interface{}{})
+
+		equal(t, 0, resp.Data["deleted"])
+		equal(t, 0, len(mc.deletedUsers))
+		if len(resp.Warnings) != 1 {
+			t.Fatalf("expected a warning for the role, actual: %v", resp.Warnings)
+		}
+	})
+
+	t.Run("Roles without the marker are not tidied", func(t *testing.T) {
+		b, s, mc := setup(t)
+		role := map[string]interface{}{}
+		for k, v := range userRole {
+			role[k] = v
+		}
+		role["metadata_attributes"] = map[string]interface{}{}
+		testRoleCreate(t, b, s, "test_role", role)
+
+		resp := testTidy(t, b, s, map[string]interface{}{
+			"safety_buffer": 0,
+		})
+
+		equal(t, 0, resp.Data["deleted"])
+		equal(t, 0, len(mc.deletedUsers))
+		if len(resp.Warnings) != 1 {
+			t.Fatalf("expected a warning for the role, actual: %v", resp.Warnings)
+		}
+	})
+
+	t.Run("Revoked users are untracked", func(t *testing.T) {
+		b, s, mc := setup(t)
+		username := mc.poolUsers[0].Username
+
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret: &logical.Secret{
+				InternalData: map[string]interface{}{
+					"secret_type": SecretTypeUser,
+					"username":    username,
+					"role":        "test_role",
+				},
+			},
+			Storage: s,
+		})
+		assertErrorIsNil(t, err)
+
+		entry, err := getUserEntry(context.Background(), s, userKey("eu-west-1", "eu-west-1_aaaaaaaaa", username))
+		assertErrorIsNil(t, err)
+		if entry != nil {
+			t.Fatalf("expected user entry to be deleted, actual: %#v", entry)
+		}
+	})
+}
+
+// Utility function to run tidy and fail on errors
+func testTidy(t *testing.T, b *cognitoSecretBackend, s logical.Storage, d map[string]interface{}) *logical.Response {
+	t.Helper()
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation:  logical.UpdateOperation,
+		Path:       "tidy",
+		Data:       d,
+		Storage:    s,
+		MountPoint: "cognito/",
+	})
+	assertErrorIsNil(t, err)
+
+	if resp.IsError() {
+		t.Fatalf("expected no response error, actual:%#v", resp.Error())
+	}
+	return resp
+}
@@ -0,0 +1,168 @@
+package cognito
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+const (
+	usageStoragePath = "usage"
+
+	// usageMonthFormat formats the calendar month that monthly usage is counted in
+	usageMonthFormat = "2006-01"
+)
+
+// roleUsage counts the users created for a role, to enforce the role's limits
+type roleUsage struct {
+	ActiveUsers int `json:"active_users"`
+	// Month is the calendar month, in UTC, that MonthlyUsers counts users for
+	Month        string `json:"month"`
+	MonthlyUsers int    `json:"monthly_users"`
+}
+
+func pathUsage(b *cognitoSecretBackend) *framework.Path {
+	return &framework.Path{
+		Pattern: "roles/" + framework.GenericNameRegex("name") + "/usage",
+		Fields: map[string]*framework.FieldSchema{
+			"name": {
+				Type:        framework.TypeLowerCaseString,
+				Description: "Name of the role.",
+			},
+		},
+		Callbacks: map[logical.Operation]framework.OperationFunc{
+			logical.ReadOperation: b.pathUsageRead,
+		},
+		HelpSynopsis:    pathUsageHelpSyn,
+		HelpDescription: pathUsageHelpDesc,
+	}
+}
+
+func (b *cognitoSecretBackend) pathUsageRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	role, err := getRole(ctx, name, req.Storage)
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading role: {{err}}", err)
+	}
+
+	if role == nil {
+		return nil, nil
+	}
+
+	b.usageLock.Lock()
+	defer b.usageLock.Unlock()
+
+	usage, err := getRoleUsage(ctx, req.Storage, name, time.Now())
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading role usage: {{err}}", err)
+	}
+
+	return &logical.Response{
+		Data: map[string]interface{}{
+			"active_users":        usage.ActiveUsers,
+			"max_active_users":    role.MaxActiveUsers,
+			"month":               usage.Month,
+			"users_this_month":    usage.MonthlyUsers,
+			"max_users_per_month": role.MaxUsersPerMonth,
+		},
+	}, nil
+}
+
+// reserveUser counts a new user against the role's limits, a 429 coded error
+// is returned if the role has reached either limit. The reservation must be
+// released if the user is not created.
+func (b *cognitoSecretBackend) reserveUser(ctx context.Context, s logical.Storage, roleName string, role *roleEntry) error {
+	b.usageLock.Lock()
+	defer b.usageLock.Unlock()
+
+	usage, err := getRoleUsage(ctx, s, roleName, time.Now())
+	if err != nil {
+		return errwrap.Wrapf("error reading role usage: {{err}}", err)
+	}
+
+	if role.MaxActiveUsers > 0 && usage.ActiveUsers >= role.MaxActiveUsers {
+		return logical.CodedError(http.StatusTooManyRequests, fmt.Sprintf("role '%s' has reached its limit of %d active users", roleName, role.MaxActiveUsers))
+	}
+
+	if role.MaxUsersPerMonth > 0 && usage.MonthlyUsers >= role.MaxUsersPerMonth {
+		return logical.CodedError(http.StatusTooManyRequests, fmt.Sprintf("role '%s' has reached its limit of %d users in %s", roleName, role.MaxUsersPerMonth, usage.Month))
+	}
+
+	usage.ActiveUsers++
+	usage.MonthlyUsers++
+
+	return saveRoleUsage(ctx, s, roleName, usage)
+}
+
+// releaseUser removes a user from the role's usage, either because the user was
+// revoked or, if created is false, because creating the user failed.
+func (b *cognitoSecretBackend) releaseUser(ctx context.Context, s logical.Storage, roleName string, created bool) error {
+	b.usageLock.Lock()
+	defer b.usageLock.Unlock()
+
+	now := time.Now()
+	usage, err := getRoleUsage(ctx, s, roleName, now)
+	if err != nil {
+		return errwrap.Wrapf("error reading role usage: {{err}}", err)
+	}
+
+	if usage.ActiveUsers > 0 {
+		usage.ActiveUsers--
+	}
+
+	if !created && usage.MonthlyUsers > 0 {
+		usage.MonthlyUsers--
+	}
+
+	return saveRoleUsage(ctx, s, roleName, usage)
+}
+
+// getRoleUsage reads the usage of a role, the monthly count is reset if the
+// month has changed since it was last saved.
+func getRoleUsage(ctx context.Context, s logical.Storage, roleName string, now time.Time) (*roleUsage, error) {
+	month := now.UTC().Format(usageMonthFormat)
+
+	entry, err := s.Get(ctx, fmt.Sprintf("%s/%s", usageStoragePath, roleName))
+	if err != nil {
+		return nil, err
+	}
+
+	usage := &roleUsage{Month: month}
+	if entry != nil {
+		if err := entry.DecodeJSON(usage); err != nil {
+			return nil, err
+		}
+	}
+
+	if usage.Month != month {
+		usage.Month = month
+		usage.MonthlyUsers = 0
+	}
+
+	return usage, nil
+}
+
+func saveRoleUsage(ctx context.Context, s logical.Storage, roleName string, usage *roleUsage) error {
+	entry, err := logical.StorageEntryJSON(fmt.Sprintf("%s/%s", usageStoragePath, roleName), usage)
+	if err != nil {
+		return err
+	}
+
+	return s.Put(ctx, entry)
+}
+
+const pathUsageHelpSyn = `
+Report the number of users created for a role.
+`
+
+const pathUsageHelpDesc = `
+This path reports the number of users with an active lease and the number
+of users created this month for the role, along with the role's limits.
+A limit of 0 means that the role is not limited.
+`
@@ -0,0 +1,136 @@
+package cognito
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestRoleUsage(t *testing.T) {
+	setup := func(t *testing.T, role map[string]interface{}) (*cognitoSecretBackend, logical.Storage) {
+		b, s := getTestBackend(t, true)
+		role["credential_type"] = "user"
+		role["region"] = "eu-west-1"
+		role["user_pool_id"] = "eu-west-1_aaaa"
+		role["app_client_id"] = "testAppClientId"
+		role["group"] = "testGroup"
+		testRoleCreate(t, b, s, "test_role", role)
+		return b, s
+	}
+
+	creds := func(b *cognitoSecretBackend, s logical.Storage) (*logical.Response, error) {
+		return b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/test_role",
+			Storage:   s,
+		})
+	}
+
+	revoke := func(t *testing.T, b *cognitoSecretBackend, s logical.Storage, username string) {
+		t.Helper()
+		_, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RevokeOperation,
+			Secret: &logical.Secret{
+				InternalData: map[string]interface{}{
+					"secret_type": SecretTypeUser,
+					"username":    username,
+					"role":        "test_role",
+				},
+			},
+			Storage: s,
+		})
+		assertErrorIsNil(t, err)
+	}
+
+	usage := func(t *testing.T, b *cognitoSecretBackend, s logical.Storage) map[string]interface{} {
+		t.Helper()
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "roles/test_role/usage",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		return resp.Data
+	}
+
+	assertTooManyRequests := func(t *testing.T, err error) {
+		t.Helper()
+		codedErr, ok := err.(logical.HTTPCodedError)
+		if !ok {
+			t.Fatalf("expected a coded error, actual: %#v", err)
+		}
+		equal(t, http.StatusTooManyRequests, codedErr.Code())
+	}
+
+	t.Run("Max active users", func(t *testing.T) {
+		b, s := setup(t, map[string]interface{}{
+			"max_active_users": 1,
+		})
+
+		resp, err := creds(b, s)
+		assertErrorIsNil(t, err)
+		username := resp.Data["username"].(string)
+
+		_, err = creds(b, s)
+		assertTooManyRequests(t, err)
+
+		data := usage(t, b, s)
+		equal(t, 1, data["active_users"])
+		equal(t, 1, data["max_active_users"])
+		equal(t, 1, data["users_this_month"])
+
+		// revoking the user frees up the slot, revoking it again has no effect
+		revoke(t, b, s, username)
+		revoke(t, b, s, username)
+		equal(t, 0, usage(t, b, s)["active_users"])
+
+		_, err = creds(b, s)
+		assertErrorIsNil(t, err)
+	})
+
+	t.Run("Max users per month", func(t *testing.T) {
+		b, s := setup(t, map[string]interface{}{
+			"max_users_per_month": 2,
+		})
+
+		for i := 0; i < 2; i++ {
+			resp, err := creds(b, s)
+			assertErrorIsNil(t, err)
+			revoke(t, b, s, resp.Data["username"].(string))
+		}
+
+		_, err := creds(b, s)
+		assertTooManyRequests(t, err)
+
+		data := usage(t, b, s)
+		equal(t, 0, data["active_users"])
+		equal(t, 2, data["users_this_month"])
+		equal(t, 2, data["max_users_per_month"])
+		equal(t, time.Now().UTC().Format(usageMonthFormat), data["month"])
+
+		// the count is reset in the next month
+		entry, err := getRoleUsage(context.Background(), s, "test_role", time.Now().AddDate(0, 1, 0))
+		assertErrorIsNil(t, err)
+		equal(t, 0, entry.MonthlyUsers)
+	})
+
+	t.Run("Failed users are not counted", func(t *testing.T) {
+		b, s := setup(t, map[string]interface{}{
+			"max_active_users": 1,
+		})
+		b.client.(*mockClient).newUserErr = errors.New("user pool unavailable")
+
+		_, err := creds(b, s)
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+
+		data := usage(t, b, s)
+		equal(t, 0, data["active_users"])
+		equal(t, 0, data["users_this_month"])
+	})
+}
@@ -0,0 +1,169 @@
+package cognito
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/framework"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func pathsUsers(b *cognitoSecretBackend) []*framework.Path {
+	return []*framework.Path{
+		{
+			Pattern: "roles/" + framework.GenericNameRegex("name") + "/users/?$",
+			Fields: map[string]*framework.FieldSchema{
+				"name": {
+					Type:        framework.TypeLowerCaseString,
+					Description: "Name of the role.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathRoleUsersList,
+			},
+			HelpSynopsis:    roleUsersListHelpSyn,
+			HelpDescription: roleUsersListHelpDesc,
+		},
+		{
+			Pattern: "users/?$",
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ListOperation: b.pathUsersList,
+			},
+			HelpSynopsis:    usersListHelpSyn,
+			HelpDescription: usersListHelpDesc,
+		},
+		{
+			Pattern: "users/" + framework.GenericNameRegex("region") + "/" + framework.GenericNameRegex("user_pool_id") + "/" + framework.MatchAllRegex("username"),
+			Fields: map[string]*framework.FieldSchema{
+				"region": {
+					Type:        framework.TypeString,
+					Description: "Region of the user pool.",
+				},
+				"user_pool_id": {
+					Type:        framework.TypeString,
+					Description: "ID of the user pool.",
+				},
+				"username": {
+					Type:        framework.TypeString,
+					Description: "Username of the user.",
+				},
+			},
+			Callbacks: map[logical.Operation]framework.OperationFunc{
+				logical.ReadOperation: b.pathUserRead,
+			},
+			HelpSynopsis:    userHelpSyn,
+			HelpDescription: userHelpDesc,
+		},
+	}
+}
+
+func (b *cognitoSecretBackend) pathRoleUsersList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	name := d.Get("name").(string)
+
+	users, err := roleUserEntries(ctx, req.Storage, name)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(users))
+	for _, user := range users {
+		keys = append(keys, user.key())
+	}
+	sort.Strings(keys)
+
+	return logical.ListResponse(keys), nil
+}
+
+func (b *cognitoSecretBackend) pathUsersList(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	keys, err := listUserEntries(ctx, req.Storage)
+	if err != nil {
+		return nil, errwrap.Wrapf("error listing users: {{err}}", err)
+	}
+
+	return logical.ListResponse(keys), nil
+}
+
+func (b *cognitoSecretBackend) pathUserRead(ctx context.Context, req *logical.Request, d *framework.FieldData) (*logical.Response, error) {
+	key := userKey(d.Get("region").(string), d.Get("user_pool_id").(string), d.Get("username").(string))
+
+	user, err := getUserEntry(ctx, req.Storage, key)
+	if err != nil {
+		return nil, errwrap.Wrapf("error reading user entry: {{err}}", err)
+	}
+
+	if user == nil {
+		return nil, nil
+	}
+
+	data := map[string]interface{}{
+		"username":     user.Username,
+		"role":         user.Role,
+		"region":       user.Region,
+		"user_pool_id": user.UserPoolId,
+		"entity_id":    user.EntityID,
+		"create_time":  formatTime(user.CreateTime),
+		"expire_time":  formatTime(user.ExpireTime),
+	}
+	resp := &logical.Response{
+		Data: data,
+	}
+
+	client, err := b.getClient(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	// the status is read from the user pool, so that users that have been changed
+	// or deleted outside of Vault can be spotted
+	poolUser, err := client.getUser(ctx, user.Region, user.UserPoolId, user.Username)
+	if err != nil {
+		resp.AddWarning(fmt.Sprintf("unable to get user from user pool %s: %s", user.UserPoolId, err))
+		return resp, nil
+	}
+
+	data["status"] = poolUser.Status
+	data["enabled"] = poolUser.Enabled
+
+	return resp, nil
+}
+
+// formatTime formats a time as RFC3339, or returns an empty string for the zero
+// time, e.g. the expiry of a user created before expiry was recorded
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+const roleUsersListHelpSyn = `
+List the users with an active lease that were created for a role.
+`
+
+const roleUsersListHelpDesc = `
+This path lists the users created by this backend for the role that
+have an active lease, as <region>/<user_pool_id>/<username>.
+`
+
+const usersListHelpSyn = `
+List the users with an active lease.
+`
+
+const usersListHelpDesc = `
+This path lists all users created by this backend that have an active
+lease, as <region>/<user_pool_id>/<username>. Users are listed by their
+user pool as roles on different user pools may create the same username.
+`
+
+const userHelpSyn = `
+Look up a user with an active lease.
+`
+
+const userHelpDesc = `
+This path returns the role, user pool, requesting entity, creation time
+and expected expiry of a user created by this backend, along with the
+status of the user read from the user pool.
+`
@@ -0,0 +1,277 @@
+package cognito
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+func TestUsers(t *testing.T) {
+	// the users are all created in the same user pool
+	poolKey := func(username string) string {
+		return userKey("eu-west-1", "eu-west-1_aaaa", username)
+	}
+
+	setup := func(t *testing.T) (*cognitoSecretBackend, logical.Storage, []string) {
+		b, s := getTestBackend(t, true)
+		b.System().(*logical.StaticSystemView).EntityVal = &logical.Entity{ID: "test-entity"}
+
+		testRoleCreate(t, b, s, "role_a", map[string]interface{}{
+			"credential_type": "user",
+			"app_client_id":   "testAppClientId",
+			"region":          "eu-west-1",
+			"user_pool_id":    "eu-west-1_aaaa",
+			"group":           "testGroup",
+			"ttl":             300,
+		})
+		testRoleCreate(t, b, s, "role_b", map[string]interface{}{
+			"credential_type": "user",
+			"region":          "eu-west-1",
+			"user_pool_id":    "eu-west-1_aaaa",
+			"group":           "testGroup",
+			"app_client_id":   "testAppClientId",
+		})
+
+		var usernames []string
+		for i, role := range []string{"role_a", "role_a", "role_b"} {
+			resp, err := b.HandleRequest(context.Background(), &logical.Request{
+				Operation: logical.ReadOperation,
+				Path:      "creds/" + role,
+				Storage:   s,
+				EntityID:  "test-entity",
+			})
+			assertErrorIsNil(t, err)
+
+			if resp.IsError() {
+				t.Fatalf("expected no response error, actual:%#v", resp.Error())
+			}
+
+			// the mock client always returns the same username, so record each
+			// user under the username it was created with
+			user, err := getUserEntry(context.Background(), s, poolKey(resp.Data["username"].(string)))
+			assertErrorIsNil(t, err)
+			assertErrorIsNil(t, deleteUserEntry(context.Background(), s, user.key()))
+			user.Username = b.client.(*mockClient).newUserInputs[i].Username
+			assertErrorIsNil(t, saveUserEntry(context.Background(), s, user))
+
+			usernames = append(usernames, user.Username)
+		}
+
+		return b, s, usernames
+	}
+
+	t.Run("List role users", func(t *testing.T) {
+		b, s, usernames := setup(t)
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "roles/role_a/users",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+
+		keys := resp.Data["keys"].([]string)
+		equal(t, 2, len(keys))
+		for _, username := range usernames[:2] {
+			found := false
+			for _, key := range keys {
+				found = found || key == poolKey(username)
+			}
+			if !found {
+				t.Fatalf("expected %s in %v", username, keys)
+			}
+		}
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ListOperation,
+			Path:      "users",
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		equal(t, 3, len(resp.Data["keys"].([]string)))
+	})
+
+	t.Run("Read user", func(t *testing.T) {
+		b, s, usernames := setup(t)
+		b.client.(*mockClient).poolUsers = []*poolUser{
+			{Username: usernames[0], Status: "CONFIRMED", Enabled: true},
+		}
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "users/" + poolKey(usernames[0]),
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+
+		equal(t, usernames[0], resp.Data["username"])
+		equal(t, "role_a", resp.Data["role"])
+		equal(t, "eu-west-1", resp.Data["region"])
+		equal(t, "eu-west-1_aaaa", resp.Data["user_pool_id"])
+		equal(t, "test-entity", resp.Data["entity_id"])
+		equal(t, "CONFIRMED", resp.Data["status"])
+		equal(t, true, resp.Data["enabled"])
+
+		createTime, err := time.Parse(time.RFC3339, resp.Data["create_time"].(string))
+		assertErrorIsNil(t, err)
+		expireTime, err := time.Parse(time.RFC3339, resp.Data["expire_time"].(string))
+		assertErrorIsNil(t, err)
+		if expireTime.Sub(createTime).Round(time.Minute) != 5*time.Minute {
+			t.Fatalf("expected the user to expire after the ttl, created %s, expires %s", createTime, expireTime)
+		}
+
+		// users missing from the user pool are still returned, with a warning
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "users/" + poolKey(usernames[2]),
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		equal(t, "role_b", resp.Data["role"])
+		equal(t, 1, len(resp.Warnings))
+		if _, ok := resp.Data["status"]; ok {
+			t.Fatal("expected no status for a user missing from the user pool")
+		}
+
+		resp, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "users/" + poolKey("unknown@example.com"),
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		if resp != nil {
+			t.Fatalf("expected no response for an unknown user, actual: %#v", resp)
+		}
+	})
+
+	t.Run("Renew updates expiry", func(t *testing.T) {
+		b, s, usernames := setup(t)
+
+		user, err := getUserEntry(context.Background(), s, poolKey(usernames[0]))
+		assertErrorIsNil(t, err)
+		user.ExpireTime = time.Time{}
+		assertErrorIsNil(t, saveUserEntry(context.Background(), s, user))
+
+		_, err = b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.RenewOperation,
+			Secret: &logical.Secret{
+				InternalData: map[string]interface{}{
+					"secret_type": SecretTypeUser,
+					"username":    usernames[0],
+					"role":        "role_a",
+				},
+				LeaseOptions: logical.LeaseOptions{
+					IssueTime: time.Now(),
+				},
+			},
+			Storage: s,
+		})
+		assertErrorIsNil(t, err)
+
+		user, err = getUserEntry(context.Background(), s, poolKey(usernames[0]))
+		assertErrorIsNil(t, err)
+		if user.ExpireTime.Sub(time.Now()).Round(time.Minute) != 5*time.Minute {
+			t.Fatalf("expected the expiry to be renewed, actual: %s", user.ExpireTime)
+		}
+	})
+}
+
+func TestUsersWithTheSameUsernameInDifferentPools(t *testing.T) {
+	b, s := getTestBackend(t, true)
+	mc := b.client.(*mockClient)
+
+	// both roles create users named shared-user, in different user pools
+	pools := map[string][]string{
+		"role_a": {"eu-west-1", "eu-west-1_aaaa"},
+		"role_b": {"eu-west-2", "eu-west-2_bbbb"},
+	}
+	secrets := map[string]*logical.Secret{}
+	var username string
+	for _, role := range []string{"role_a", "role_b"} {
+		testRoleCreate(t, b, s, role, map[string]interface{}{
+			"credential_type":   "user",
+			"app_client_id":     "testAppClientId",
+			"region":            pools[role][0],
+			"user_pool_id":      pools[role][1],
+			"group":             "testGroup",
+			"username_template": "shared-user",
+		})
+
+		resp, err := b.HandleRequest(context.Background(), &logical.Request{
+			Operation: logical.ReadOperation,
+			Path:      "creds/" + role,
+			Storage:   s,
+		})
+		assertErrorIsNil(t, err)
+		if resp.IsError() {
+			t.Fatalf("expected no response error, actual:%#v", resp.Error())
+		}
+		equal(t, "shared-user", mc.newUserInputs[len(mc.newUserInputs)-1].Username)
+
+		// the mock client returns the same username for every user
+		username = resp.Data["username"].(string)
+		fakeSaveLoad(resp.Secret)
+		secrets[role] = resp.Secret
+	}
+
+	keyA := userKey("eu-west-1", "eu-west-1_aaaa", username)
+	keyB := userKey("eu-west-2", "eu-west-2_bbbb", username)
+
+	resp, err := b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ListOperation,
+		Path:      "users",
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+	equal(t, []string{keyA, keyB}, resp.Data["keys"])
+
+	resp, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.ReadOperation,
+		Path:      "users/" + keyB,
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+	equal(t, "role_b", resp.Data["role"])
+	equal(t, "eu-west-2_bbbb", resp.Data["user_pool_id"])
+
+	// revoking the user of one role leaves the user of the other role tracked
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    secrets["role_a"],
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+
+	user, err := getUserEntry(context.Background(), s, keyA)
+	assertErrorIsNil(t, err)
+	if user != nil {
+		t.Fatalf("expected the user of role_a to be untracked, actual: %#v", user)
+	}
+	user, err = getUserEntry(context.Background(), s, keyB)
+	assertErrorIsNil(t, err)
+	if user == nil || user.Role != "role_b" {
+		t.Fatalf("expected the user of role_b to be tracked, actual: %#v", user)
+	}
+
+	// failed revocations of both users are queued separately
+	mc.deleteUserErr = errors.New("TooManyRequestsException: Rate exceeded")
+	assertErrorIsNil(t, queueRevocation(context.Background(), s, &revocationEntry{
+		Username:   username,
+		Role:       "role_a",
+		Region:     "eu-west-1",
+		UserPoolId: "eu-west-1_aaaa",
+	}, mc.deleteUserErr, time.Now()))
+	_, err = b.HandleRequest(context.Background(), &logical.Request{
+		Operation: logical.RevokeOperation,
+		Secret:    secrets["role_b"],
+		Storage:   s,
+	})
+	assertErrorIsNil(t, err)
+
+	keys, err := listRevocationEntries(context.Background(), s)
+	assertErrorIsNil(t, err)
+	equal(t, []string{keyA, keyB}, keys)
+}
@@ -0,0 +1,133 @@
+package cognito
+
+import (
+	"fmt"
+
+	"github.com/hashicorp/errwrap"
+	"github.com/hashicorp/vault/sdk/helper/template"
+	"github.com/hashicorp/vault/sdk/logical"
+)
+
+// templateData is the data available to the templates in a role, e.g.
+// {{.RoleName}} or {{index .Entity.Metadata "tenant_id"}}
+type templateData struct {
+	RoleName         string
+	DisplayName      string
+	DummyEmailDomain string
+	UsernameSuffix   string
+	Entity           templateEntity
+
+	// TTL is the lease TTL in seconds and ExpiresAt is when the lease expires,
+	// formatted as RFC3339
+	TTL       int64
+	ExpiresAt string
+
+	// Email, PhoneNumber and Username are set once they have been generated, the
+	// email is available to the username template and all are available to the
+	// user attribute templates.
+	Email       string
+	PhoneNumber string
+	Username    string
+}
+
+// templateEntity is the identity entity of the requester
+type templateEntity struct {
+	ID       string
+	Name     string
+	Metadata map[string]string
+	// Aliases are the entity's aliases keyed by mount accessor
+	Aliases map[string]templateAlias
+}
+
+// templateAlias is an alias of the requester's identity entity
+type templateAlias struct {
+	Name      string
+	MountType string
+	Metadata  map[string]string
+}
+
+// newTemplateData builds the template data for a request against the named role.
+func (b *cognitoSecretBackend) newTemplateData(req *logical.Request, roleName string, role *roleEntry) (*templateData, error) {
+	data := &templateData{
+		RoleName:         roleName,
+		DisplayName:      req.DisplayName,
+		DummyEmailDomain: role.DummyEmailDomain,
+		Entity: templateEntity{
+			Metadata: map[string]string{},
+			Aliases:  map[string]templateAlias{},
+		},
+	}
+
+	if req.EntityID == "" {
+		return data, nil
+	}
+
+	entity, err := b.System().EntityInfo(req.EntityID)
+	if err != nil {
+		return nil, errwrap.Wrapf("error looking up identity entity: {{err}}", err)
+	}
+
+	if entity == nil {
+		return data, nil
+	}
+
+	data.Entity.ID = entity.ID
+	data.Entity.Name = entity.Name
+	for k, v := range entity.Metadata {
+		data.Entity.Metadata[k] = v
+	}
+	for _, alias := range entity.Aliases {
+		data.Entity.Aliases[alias.MountAccessor] = templateAlias{
+			Name:      alias.Name,
+			MountType: alias.MountType,
+			Metadata:  stringMap(alias.Metadata),
+		}
+	}
+
+	return data, nil
+}
+
+// parseTemplate parses a role template, the template functions are those of
+// Vault's username templates, e.g. random, truncate and unix_time, and
+// random_digits.
+func parseTemplate(rawTemplate string) (template.StringTemplate, error) {
+	return template.NewTemplate(
+		template.Template(rawTemplate),
+		template.Function("random_digits", randomDigits),
+	)
+}
+
+// randomDigits generates a random string of digits of the given length
+func randomDigits(length int) (string, error) {
+	digits := make([]byte, length)
+	for i := range digits {
+		c, err := randomChar(passwordNumbers)
+		if err != nil {
+			return "", err
+		}
+		digits[i] = c
+	}
+	return string(digits), nil
+}
+
+// renderTemplate renders a single template with the given data.
+func renderTemplate(rawTemplate string, data *templateData) (string, error) {
+	tmpl, err := parseTemplate(rawTemplate)
+	if err != nil {
+		return "", err
+	}
+	return tmpl.Generate(data)
+}
+
+// renderTemplates renders each of the templates in a map with the given data.
+func renderTemplates(templates map[string]string, data *templateData) (map[string]string, error) {
+	rendered := make(map[string]string, len(templates))
+	for name, rawTemplate := range templates {
+		value, err := renderTemplate(rawTemplate, data)
+		if err != nil {
+			return nil, errwrap.Wrapf(fmt.Sprintf("unable to render template for '%s': {{err}}", name), err)
+		}
+		rendered[name] = value
+	}
+	return rendered, nil
+}
@@ -0,0 +1,214 @@
+package cognito
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/errwrap"
+)
+
+const (
+	attributeEmail               = "email"
+	attributeEmailVerified       = "email_verified"
+	attributePhoneNumber         = "phone_number"
+	attributePhoneNumberVerified = "phone_number_verified"
+	attributePreferredUsername   = "preferred_username"
+)
+
+// generateUsername renders the role's email and username templates, the
+// generated values are added to the template data. Any username suffix is
+// added to the username, before the @ if the username is an email address.
+func generateUsername(role *roleEntry, data *templateData) (string, string, error) {
+	emailTemplate := role.EmailTemplate
+	if emailTemplate == "" {
+		emailTemplate = defaultEmailTemplate
+	}
+	// without a domain the default template would generate an address ending in @
+	if emailTemplate == defaultEmailTemplate && role.DummyEmailDomain == "" {
+		emailTemplate = defaultEmailLocalTemplate
+	}
+
+	email, err := renderTemplate(emailTemplate, data)
+	if err != nil {
+		return "", "", errwrap.Wrapf("unable to generate email: {{err}}", err)
+	}
+	data.Email = email
+
+	usernameTemplate := role.UsernameTemplate
+	if usernameTemplate == "" {
+		usernameTemplate = defaultUsernameTemplate
+	}
+
+	username, err := renderTemplate(usernameTemplate, data)
+	if err != nil {
+		return "", "", errwrap.Wrapf("unable to generate username: {{err}}", err)
+	}
+	if username == "" {
+		return "", "", errors.New("username_template generated an empty username")
+	}
+
+	if data.UsernameSuffix != "" {
+		if username == email {
+			email = addUsernameSuffix(email, data.UsernameSuffix)
+			data.Email = email
+		}
+		username = addUsernameSuffix(username, data.UsernameSuffix)
+	}
+	data.Username = username
+
+	return email, username, nil
+}
+
+// addUsernameSuffix adds the suffix to the username, before the @ if the username
+// is an email address
+func addUsernameSuffix(username string, suffix string) string {
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		return username[:i] + suffix + username[i:]
+	}
+	return username + suffix
+}
+
+// newPassword generates a password for a new user, either from the role's Vault
+// password policy or randomly. The password is checked against the user pool's
+// password policy.
+func (b *cognitoSecretBackend) newPassword(ctx context.Context, role *roleEntry, userPool *userPoolDetails) (string, error) {
+	if role.PasswordPolicy == "" {
+		return generatePassword(userPool.PasswordPolicy)
+	}
+
+	password, err := b.System().GeneratePasswordFromPolicy(ctx, role.PasswordPolicy)
+	if err != nil {
+		return "", errwrap.Wrapf(fmt.Sprintf("unable to generate password from policy '%s': {{err}}", role.PasswordPolicy), err)
+	}
+
+	if err := userPool.PasswordPolicy.check(password); err != nil {
+		return "", errwrap.Wrapf(fmt.Sprintf("password generated from policy '%s' does not satisfy the user pool password policy: {{err}}", role.PasswordPolicy), err)
+	}
+
+	return password, nil
+}
+
+// generatePhoneNumber renders the role's phone number template, the generated
+// value is added to the template data.
+func generatePhoneNumber(role *roleEntry, data *templateData) (string, error) {
+	phoneNumberTemplate := role.PhoneNumberTemplate
+	if phoneNumberTemplate == "" {
+		phoneNumberTemplate = defaultPhoneNumberTemplate
+	}
+
+	phoneNumber, err := renderTemplate(phoneNumberTemplate, data)
+	if err != nil {
+		return "", errwrap.Wrapf("unable to generate phone number: {{err}}", err)
+	}
+	data.PhoneNumber = phoneNumber
+
+	return phoneNumber, nil
+}
+
+// providerAttributeName returns the provider attribute that identifies the
+// linked identity. Roles stored before users could be linked have no provider
+// attribute name, as the default was only set on new roles.
+func providerAttributeName(role *roleEntry) string {
+	if role.ProviderAttributeName == "" {
+		return defaultProviderAttributeName
+	}
+	return role.ProviderAttributeName
+}
+
+// generateProviderSubject renders the role's provider subject template, which
+// identifies the identity provider user that the created user is linked to.
+func generateProviderSubject(role *roleEntry, data *templateData) (string, error) {
+	providerSubjectTemplate := role.ProviderSubjectTemplate
+	if providerSubjectTemplate == "" {
+		providerSubjectTemplate = defaultProviderSubjectTemplate
+	}
+
+	subject, err := renderTemplate(providerSubjectTemplate, data)
+	if err != nil {
+		return "", errwrap.Wrapf("unable to generate provider subject: {{err}}", err)
+	}
+	if subject == "" {
+		return "", errors.New("provider_subject_template generated an empty subject")
+	}
+
+	return subject, nil
+}
+
+// usesAttribute reports whether the user pool needs the attribute to be set on
+// its users, because it is a username attribute, an alias attribute or required.
+func (p *userPoolDetails) usesAttribute(name string) bool {
+	for _, attributes := range [][]string{p.UsernameAttributes, p.AliasAttributes, p.RequiredAttributes} {
+		for _, attribute := range attributes {
+			if attribute == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isUsernameAttribute reports whether the attribute can be used as the username
+func (p *userPoolDetails) isUsernameAttribute(name string) bool {
+	for _, attribute := range p.UsernameAttributes {
+		if attribute == name {
+			return true
+		}
+	}
+	return false
+}
+
+// poolUsername returns the username to create the user with. Pools that use
+// email or phone number as the username require the username to be one of those.
+func (p *userPoolDetails) poolUsername(username string, email string, phoneNumber string) string {
+	switch {
+	case p.isUsernameAttribute(attributeEmail):
+		return email
+	case p.isUsernameAttribute(attributePhoneNumber):
+		return phoneNumber
+	default:
+		return username
+	}
+}
+
+// identityAttributes returns the verified contact and preferred username
+// attributes for a new user in the user pool.
+func (p *userPoolDetails) identityAttributes(username string, email string, phoneNumber string) map[string]string {
+	attributes := map[string]string{}
+
+	if email != "" {
+		attributes[attributeEmail] = email
+		attributes[attributeEmailVerified] = "true"
+	}
+
+	if phoneNumber != "" {
+		attributes[attributePhoneNumber] = phoneNumber
+		attributes[attributePhoneNumberVerified] = "true"
+	}
+
+	if p.usesAttribute(attributePreferredUsername) {
+		// the preferred username cannot be an email address when email is an alias
+		attributes[attributePreferredUsername] = strings.SplitN(username, "@", 2)[0]
+	}
+
+	return attributes
+}
+
+// checkRequiredAttributes returns an error naming any of the user pool's required
+// attributes that are not set.
+func (p *userPoolDetails) checkRequiredAttributes(attributes map[string]string) error {
+	var missing []string
+	for _, name := range p.RequiredAttributes {
+		if attributes[name] == "" {
+			missing = append(missing, name)
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("the user pool requires attributes that are not set by the role: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}